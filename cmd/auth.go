@@ -3,186 +3,57 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"strings"
-	"time"
 
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/commands"
 	"github.com/Arvintian/chatgpt-web/pkg/controllers"
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
 	"github.com/gin-gonic/gin"
 	"k8s.io/klog/v2"
 )
 
-var help = `#### 帮助命令
-- /help 获取帮助信息
-- /me 获取用户信息、Token余额
-- /model 设置使用模型: model_name,temperature,presence,frequency,max_tokens
-- /user 新账户:新密码 更改账户、密码
-- /login 登录、重新登录
+// Authenticate resolves the user of a request from an api key bearer token or basic auth
+func Authenticate(ac *controllers.AccountService) func(c *gin.Context) (controllers.User, error) {
+	return func(c *gin.Context) (controllers.User, error) {
+		if key, ok := bearerKey(c); ok {
+			user, authCode := ac.WithContext(c).AuthenticateAPIKey(key)
+			if authCode == 1 {
+				return user, apierror.Errorf(apierror.AuthFailed, "auth.invalid.key")
+			}
+			return user, nil
+		}
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			return controllers.User{}, commands.ErrNoCredentials
+		}
+		return ac.WithContext(c).GetUser(username, password)
+	}
+}
 
-[自助中心](%s)
-`
+func bearerKey(c *gin.Context) (string, bool) {
+	auth := c.Request.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	return key, key != ""
+}
 
-func BasicAuth(ac *controllers.AccountService, link string) gin.HandlerFunc {
+func BasicAuth(ac *controllers.AccountService, registry *commands.Registry, link string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			klog.Error(err)
-			c.JSON(http.StatusOK, gin.H{
-				"status":  "Fail",
-				"message": "内部错误",
-				"data":    nil,
-			})
-			c.Abort()
+			apierror.Abort(c, apierror.Errorf(apierror.InternalError, "auth.internal.error"))
 			return
 		}
 		payload := controllers.ChatMessageRequest{}
-		if err := json.Unmarshal(body, &payload); err == nil && strings.HasPrefix(payload.Prompt, "/") {
-			switch payload.Prompt {
-			case "/help":
-				c.JSON(http.StatusOK, gin.H{
-					"status":  "Fail",
-					"message": fmt.Sprintf(help, link),
-					"data":    nil,
-				})
-				c.Abort()
-				return
-			case "/me":
-				username, password, ok := c.Request.BasicAuth()
-				message := "未登录"
-				if ok {
-					if user, err := ac.GetUser(username, password); err != nil {
-						message = "用户信息错误"
-					} else {
-						message = fmt.Sprintf("账户: %s\nToken余额: %d", user.Username, user.Balance-user.Usage)
-						if user.Model != "" {
-							message += fmt.Sprintf("\n模型配置: %s", user.Model)
-						}
-					}
-				}
-				c.JSON(http.StatusOK, gin.H{
-					"status":  "Fail",
-					"message": message,
-					"data":    nil,
-				})
-				c.Abort()
-				return
-			case "/login":
-				_, err := c.Request.Cookie("dologin")
-				if err != nil {
-					c.Header("WWW-Authenticate", "Basic realm=\"Restricted\"")
-					cookie := &http.Cookie{
-						Name:    "dologin",
-						Value:   "yes",
-						Expires: time.Now().Add(24 * time.Hour),
-						Path:    "/",
-					}
-					http.SetCookie(c.Writer, cookie)
-					c.AbortWithStatus(http.StatusUnauthorized)
-				} else {
-					cookie := &http.Cookie{
-						Name:   "dologin",
-						Value:  "yes",
-						MaxAge: -1,
-						Path:   "/",
-					}
-					http.SetCookie(c.Writer, cookie)
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "登录成功",
-						"data":    nil,
-					})
-					c.Abort()
-				}
-				return
-			}
-			if strings.HasPrefix(payload.Prompt, "/user") {
-				username, password, ok := c.Request.BasicAuth()
-				if !ok {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "未登录",
-						"data":    nil,
-					})
-					c.Abort()
-					return
-				}
-				if _, err := ac.GetUser(username, password); err != nil {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "当前用户信息错误,请输入/login登录其他账户",
-						"data":    nil,
-					})
-					c.Abort()
-					return
-				}
-				name, passwd, err := ExtractAccountAndPassword(payload.Prompt)
-				if err != nil {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": fmt.Sprintf("%v\n\n账户格式:大小写字母和数字4-12位,必须字母开头\n密码格式:大小写字母和数字6-12位", err),
-						"data":    nil,
-					})
-					c.Abort()
-					return
-				}
-				if err := ac.UpdateUser(username, password, name, passwd); err != nil {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": fmt.Sprintf("更新失败:%v", err),
-						"data":    nil,
-					})
-				} else {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "更新成功,请输入/login重新登录",
-						"data":    nil,
-					})
-				}
-				c.Abort()
-				return
-			}
-			if strings.HasPrefix(payload.Prompt, "/model") {
-				username, password, ok := c.Request.BasicAuth()
-				if !ok {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "未登录",
-						"data":    nil,
-					})
-					c.Abort()
-					return
-				}
-				if _, err := ac.GetUser(username, password); err != nil {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "当前用户信息错误,请输入/login登录其他账户",
-						"data":    nil,
-					})
-					c.Abort()
-					return
-				}
-				model := strings.Trim(strings.TrimPrefix(payload.Prompt, "/model"), " ")
-				if model == "-" {
-					model = ""
-				}
-				if err := ac.UpdateModel(username, model); err != nil {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": fmt.Sprintf("更新失败:%v", err),
-						"data":    nil,
-					})
-				} else {
-					c.JSON(http.StatusOK, gin.H{
-						"status":  "Fail",
-						"message": "更新成功",
-						"data":    nil,
-					})
-				}
-				c.Abort()
-				return
-			}
+		if err := json.Unmarshal(body, &payload); err == nil && registry.Dispatch(c, payload.Prompt) {
+			c.Abort()
+			return
 		}
 
 		c.Request.Body = io.NopCloser(bytes.NewReader(body))
@@ -193,24 +64,22 @@ func BasicAuth(ac *controllers.AccountService, link string) gin.HandlerFunc {
 			return
 		}
 
+		var user controllers.User
+		var authCode int
 		username, password, ok := c.Request.BasicAuth()
-		authCode := ac.AuthenticateUser(username, password)
+		if key, isKey := bearerKey(c); isKey {
+			user, authCode = ac.WithContext(c).AuthenticateAPIKey(key)
+			username, ok = user.Username, true
+		} else {
+			user, authCode = ac.WithContext(c).AuthenticateUser(username, password)
+		}
+		c.Set("locale", i18n.Preferred(user.Locale, c.Request.Header.Get("Accept-Language")))
 		if !ok || authCode != 0 {
-			if authCode == 1 {
-				c.JSON(http.StatusOK, gin.H{
-					"status":  "Fail",
-					"message": "账号未授权,请输入/login登录其他账户",
-					"data":    nil,
-				})
-			}
 			if authCode == 2 {
-				c.JSON(http.StatusOK, gin.H{
-					"status":  "Fail",
-					"message": fmt.Sprintf("Token数已用尽,请到[自助中心](%s)补充,您的账号: %s", link, username),
-					"data":    nil,
-				})
+				apierror.Abort(c, apierror.Errorf(apierror.QuotaExhausted, "auth.exhausted", link, username))
+			} else {
+				apierror.Abort(c, apierror.Errorf(apierror.AuthFailed, "auth.unauthorized"))
 			}
-			c.Abort()
 			return
 		}
 
@@ -223,12 +92,7 @@ func OpsAuth(theKey string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		key := c.Request.Header.Get("Opskey")
 		if key != theKey {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status":  "Fail",
-				"message": "Header Opskey error",
-				"data":    nil,
-			})
-			c.Abort()
+			apierror.Abort(c, apierror.Errorf(apierror.AuthFailed, "auth.ops.key"))
 			return
 		}
 		c.Next()
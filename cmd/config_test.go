@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func validConfig() Config {
+	return Config{
+		Server:    ServerConfig{Port: 7080, DB: "data.db"},
+		Auth:      AuthConfig{Users: []StaticUser{{Name: "alice", Password: "secret"}}},
+		Provider:  ProviderConfig{BaseURL: "https://api.openai.com/v1"},
+		Models:    ModelsConfig{Default: "gpt-4o", MaxTokens: 4096, Temperature: 0.8},
+		Chat:      ChatConfig{SessionTTL: 60, MinResponseTokens: 512},
+		Limits:    LimitsConfig{ChatRate: 1, ChatBurst: 2, RegisterRate: 1, RegisterBurst: 3},
+		Cache:     CacheConfig{Similarity: 0.95},
+		Tokenizer: TokenizerConfig{Port: 5000, Workers: 2},
+		Logging:   LoggingConfig{Format: "text"},
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // part of the error, empty for a valid config
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"port", func(c *Config) { c.Server.Port = 70000 }, "server.port"},
+		{"db", func(c *Config) { c.Server.DB = "" }, "server.db"},
+		{"comma in name", func(c *Config) { c.Auth.Users[0].Name = "a,b" }, "auth.users name"},
+		{"repeated user", func(c *Config) { c.Auth.Users = append(c.Auth.Users, c.Auth.Users[0]) }, "is repeated"},
+		{"temperature", func(c *Config) { c.Models.Temperature = 2.5 }, "models.temperature"},
+		{"min response tokens", func(c *Config) { c.Chat.MinResponseTokens = 4096 }, "chat.min_response_tokens"},
+		{"summary tokens", func(c *Config) { c.Chat.Summarize = true }, "chat.summary_tokens"},
+		{"keywords action", func(c *Config) { c.Moderation.Keywords = "words.txt"; c.Moderation.KeywordsAction = "drop" }, "moderation.keywords_action"},
+		{"similarity", func(c *Config) { c.Cache.Similarity = 1.5 }, "cache.similarity"},
+		{"tokenizer port", func(c *Config) { c.Tokenizer.Port = c.Server.Port }, "tokenizer.port"},
+		{"log format", func(c *Config) { c.Logging.Format = "xml" }, "logging.format"},
+		{"sample ratio", func(c *Config) { c.Tracing.SampleRatio = -1 }, "tracing.sample_ratio"},
+		{"all problems", func(c *Config) { c.Server.DB = ""; c.Logging.Format = "xml" }, "server.db is empty; logging.format"},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.change(&c)
+		err := c.Validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: Validate() = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Validate() = %v, want an error with %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -7,42 +7,75 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Arvintian/chatgpt-web/pkg/commands"
 	"github.com/Arvintian/chatgpt-web/pkg/controllers"
+	"github.com/Arvintian/chatgpt-web/pkg/logging"
 	"github.com/Arvintian/chatgpt-web/pkg/middlewares"
+	"github.com/Arvintian/chatgpt-web/pkg/tokenizer"
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
 	"github.com/Arvintian/chatgpt-web/pkg/utils"
 	"github.com/Arvintian/go-utils/cmdutil"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
+	"golang.org/x/time/rate"
 	"k8s.io/klog/v2"
 )
 
 type ChatGPTWebServer struct {
-	Host                   string `name:"host" env:"SERVER_HOST" usage:"http bind host" default:"0.0.0.0"`
-	Port                   int    `name:"port" env:"SERVER_PORT" usage:"http bind port" default:"7080"`
-	BasicAuthUser          string `name:"auth-user" env:"BASIC_AUTH_USER" usage:"http basic auth user"`
-	BasicAuthPassword      string `name:"auth-password" env:"BASIC_AUTH_PASSWORD" usage:"http basic auth password"`
-	OpsKey                 string `name:"ops-key" env:"OPS_KEY" default:"admin" usage:"ops key"`
-	OpsLink                string `name:"ops-link" env:"OPS_LINK" default:"/admin" usage:"ops link"`
-	DataBase               string `name:"db" env:"DB" default:"/data/chatgpt.db" usage:"mysql database url or sqlite path, user:pass@tcp(127.0.0.1:3306)/dbname?charset=utf8mb4&parseTime=True&loc=Local"`
-	FrontendPath           string `name:"frontend-path" env:"FRONTEND_PATH" default:"/app/public" usage:"frontend path"`
-	SocksProxy             string `name:"socks-proxy" env:"SOCKS_PROXY" usage:"socks proxy url"`
-	ChatSessionTTL         int    `name:"chat-session-ttl" env:"CHAT_SESSION_TTL" default:"30" usage:"chat session ttl minute"`
-	ChatMinResponseTokens  int    `name:"chat-min-response-tokens" env:"CHAT_MIN_RESPONSE_TOKENS" default:"600" usage:"chat min response tokens"`
-	OpenAIKey              string `name:"openai-key" env:"OPENAI_KEY" usage:"openai key"`
-	OpenAIBaseURL          string `name:"openai-base-url" env:"OPENAI_BASE_URL" default:"https://api.openai.com/v1" usage:"openai base url"`
-	OpenAIModel            string `name:"openai-model" env:"OPENAI_MODEL" default:"gpt-3.5-turbo" usage:"openai params model"`
-	OpenAIMaxTokens        int    `name:"openai-max-tokens" env:"OPENAI_MAX_TOKENS" default:"4096" usage:"openai params max-tokens"`
-	OpenAITemperature      int    `name:"openai-temperature" env:"OPENAI_TEMPERATURE" default:"80" usage:"openai params temperature"`
-	OpenAIPresencePenalty  int    `name:"openai-presence-penalty" env:"OPENAI_PRESENCE_PENALTY" default:"100" usage:"openai params presence-penalty"`
-	OpenAIFrequencyPenalty int    `name:"openai-frequency-penalty" env:"OPENAI_FREQUENCY_PENALTY" default:"0" usage:"openai params frequency-penalty"`
-	OpenAIProxy            bool   `name:"openai-proxy" env:"OPENAI_PROXY" usage:"enable proxy openai api"`
-	Version                bool   `name:"version" usage:"show version"`
+	Host                     string `name:"host" env:"SERVER_HOST" usage:"http bind host" default:"0.0.0.0"`
+	Port                     int    `name:"port" env:"SERVER_PORT" usage:"http bind port" default:"7080"`
+	BasicAuthUser            string `name:"auth-user" env:"BASIC_AUTH_USER" usage:"http basic auth user"`
+	BasicAuthPassword        string `name:"auth-password" env:"BASIC_AUTH_PASSWORD" usage:"http basic auth password"`
+	OpsKey                   string `name:"ops-key" env:"OPS_KEY" default:"admin" usage:"ops key"`
+	OpsLink                  string `name:"ops-link" env:"OPS_LINK" default:"/admin" usage:"ops link"`
+	DataBase                 string `name:"db" env:"DB" default:"/data/chatgpt.db" usage:"mysql database url or sqlite path, user:pass@tcp(127.0.0.1:3306)/dbname?charset=utf8mb4&parseTime=True&loc=Local"`
+	FrontendPath             string `name:"frontend-path" env:"FRONTEND_PATH" default:"/app/public" usage:"frontend path"`
+	SocksProxy               string `name:"socks-proxy" env:"SOCKS_PROXY" usage:"socks proxy url"`
+	ChatSessionTTL           int    `name:"chat-session-ttl" env:"CHAT_SESSION_TTL" default:"30" usage:"chat session ttl minute"`
+	ChatMinResponseTokens    int    `name:"chat-min-response-tokens" env:"CHAT_MIN_RESPONSE_TOKENS" default:"600" usage:"chat min response tokens"`
+	ChatSummarize            bool   `name:"chat-summarize" env:"CHAT_SUMMARIZE" usage:"summarize the history dropped from the context window"`
+	ChatSummaryTokens        int    `name:"chat-summary-tokens" env:"CHAT_SUMMARY_TOKENS" default:"400" usage:"chat summary max tokens"`
+	OpenAIKey                string `name:"openai-key" env:"OPENAI_KEY" usage:"openai key"`
+	OpenAIBaseURL            string `name:"openai-base-url" env:"OPENAI_BASE_URL" default:"https://api.openai.com/v1" usage:"openai base url"`
+	OpenAIModel              string `name:"openai-model" env:"OPENAI_MODEL" default:"gpt-3.5-turbo" usage:"openai params model"`
+	OpenAIMaxTokens          int    `name:"openai-max-tokens" env:"OPENAI_MAX_TOKENS" default:"4096" usage:"openai params max-tokens"`
+	OpenAITemperature        int    `name:"openai-temperature" env:"OPENAI_TEMPERATURE" default:"80" usage:"openai params temperature"`
+	OpenAIPresencePenalty    int    `name:"openai-presence-penalty" env:"OPENAI_PRESENCE_PENALTY" default:"100" usage:"openai params presence-penalty"`
+	OpenAIFrequencyPenalty   int    `name:"openai-frequency-penalty" env:"OPENAI_FREQUENCY_PENALTY" default:"0" usage:"openai params frequency-penalty"`
+	OpenAIProxy              bool   `name:"openai-proxy" env:"OPENAI_PROXY" usage:"enable proxy openai api"`
+	OpenAIDisableUsage       bool   `name:"openai-disable-usage" env:"OPENAI_DISABLE_USAGE" usage:"do not request stream usage, bill by local token counting"`
+	EmbeddingModel           string `name:"embedding-model" env:"EMBEDDING_MODEL" default:"text-embedding-3-small" usage:"openai embedding model for documents"`
+	RetrievalTopK            int    `name:"retrieval-top-k" env:"RETRIEVAL_TOP_K" default:"4" usage:"document chunks retrieved into the context"`
+	RetrievalTokens          int    `name:"retrieval-tokens" env:"RETRIEVAL_TOKENS" default:"1500" usage:"token budget of retrieved document chunks"`
+	Tools                    string `name:"tools" env:"TOOLS" usage:"enabled built-in tools: current_time,calculator,fetch_url,search_history"`
+	ToolsFetchAllowlist      string `name:"tools-fetch-allowlist" env:"TOOLS_FETCH_ALLOWLIST" usage:"hosts the fetch_url tool may access, comma separated"`
+	LogFormat                string `name:"log-format" env:"LOG_FORMAT" default:"text" usage:"log format: text or json"`
+	LogPrompts               bool   `name:"log-prompts" env:"LOG_PROMPTS" usage:"log prompt and completion text, redacted by default"`
+	ModerationKeywords       string `name:"moderation-keywords" env:"MODERATION_KEYWORDS" usage:"keywords file for moderation, one per line, re: prefix for regular expressions"`
+	ModerationKeywordsAction string `name:"moderation-keywords-action" env:"MODERATION_KEYWORDS_ACTION" default:"block" usage:"action of keyword matches: block, warn or log"`
+	ModerationKeywordsStages string `name:"moderation-keywords-stages" env:"MODERATION_KEYWORDS_STAGES" default:"prompt,completion" usage:"texts checked for keywords: prompt,completion"`
+	ModerationOpenAIAction   string `name:"moderation-openai-action" env:"MODERATION_OPENAI_ACTION" usage:"action of the openai moderation endpoint flags: block, warn or log, empty disables it"`
+	ModerationOpenAIModel    string `name:"moderation-openai-model" env:"MODERATION_OPENAI_MODEL" usage:"openai moderation model"`
+	ModerationOpenAIStages   string `name:"moderation-openai-stages" env:"MODERATION_OPENAI_STAGES" default:"prompt,completion" usage:"texts checked by the openai moderation endpoint: prompt,completion"`
+	Redact                   string `name:"redact" env:"REDACT" usage:"redact values before sending prompts: email,phone,credit_card,aws_key,openai_key"`
+	RedactPatterns           string `name:"redact-patterns" env:"REDACT_PATTERNS" usage:"custom redaction patterns file, one NAME=regexp per line"`
+	RedactRestore            bool   `name:"redact-restore" env:"REDACT_RESTORE" usage:"put the redacted values back into the reply"`
+	CacheTTL                 int    `name:"cache-ttl" env:"CACHE_TTL" default:"0" usage:"reply cache ttl minute, 0 disables the cache"`
+	CacheSimilarity          int    `name:"cache-similarity" env:"CACHE_SIMILARITY" default:"0" usage:"percent of embedding similarity for a semantic cache hit, 0 for exact hits only"`
+	CacheDiscount            int    `name:"cache-discount" env:"CACHE_DISCOUNT" default:"100" usage:"percent off the tokens of a cached reply, 100 is free"`
+	OTLPEndpoint             string `name:"otlp-endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" usage:"otlp http collector url to export traces, e.g. http://127.0.0.1:4318"`
+	TraceSampleRatio         int    `name:"trace-sample-ratio" env:"TRACE_SAMPLE_RATIO" default:"100" usage:"percent of traces sampled"`
+	TokenizerPort            int    `name:"tokenizer-port" env:"TOKENIZER_PORT" default:"5000" usage:"tokenizer process port"`
+	TokenizerWorkers         int    `name:"tokenizer-workers" env:"TOKENIZER_WORKERS" default:"2" usage:"tokenizer process workers"`
+	TokenizerEncodings       string `name:"tokenizer-encodings" env:"TOKENIZER_ENCODINGS" usage:"json file mapping models to tiktoken encodings and message overheads"`
+	ShutdownTimeout          int    `name:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" default:"30" usage:"seconds to wait for the chats in flight on shutdown"`
+	Config                   string `name:"config" env:"CONFIG" usage:"yaml or toml config file over the flags, reloaded when it changes"`
+	Version                  bool   `name:"version" usage:"show version"`
 }
 
 var Version = "0.0.0-dev"
@@ -52,50 +85,126 @@ func (r *ChatGPTWebServer) Run(cmd *cobra.Command, args []string) error {
 		return r.ShowVersion()
 	}
 	gin.SetMode(gin.ReleaseMode)
-	if err := r.updateAssetsFiles(r.OpsLink); err != nil {
+	store, err := newConfigStore(r.Config, r.defaultConfig())
+	if err != nil {
+		return err
+	}
+	cfg := store.Get()
+	if err := logging.Setup(cfg.Logging.Format); err != nil {
 		return err
 	}
-	go r.startTokenizer(cmd.Context())
-	go r.httpServer(cmd.Context())
+	if err := r.updateAssetsFiles(cfg.Server.FrontendPath, cfg.Server.OpsLink); err != nil {
+		return err
+	}
+	shutdownTracing, err := tracing.Setup(cmd.Context(), cfg.Tracing.OTLPEndpoint, cfg.Tracing.SampleRatio, Version)
+	if err != nil {
+		return err
+	}
+	// the tokenizer counts the tokens of the chats drained on shutdown, it is stopped after the server
+	tokenizerCtx, stopTokenizer := context.WithCancel(context.Background())
+	tokenizerDone := make(chan struct{})
+	tokenizer.SetPort(cfg.Tokenizer.Port)
+	supervisor := &tokenizer.Supervisor{Module: "tokenizer.py", Port: cfg.Tokenizer.Port, Workers: cfg.Tokenizer.Workers, Encodings: cfg.Tokenizer.Encodings}
+	go func() {
+		defer close(tokenizerDone)
+		supervisor.Run(tokenizerCtx)
+	}()
+	go store.Watch(cmd.Context())
+	r.httpServer(cmd.Context(), store)
 
-	<-cmd.Context().Done()
+	stopTokenizer()
+	<-tokenizerDone
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		klog.Error(err)
+	}
+	klog.Info("ChatGPT Web Server stopped")
 	return nil
 }
 
-func (r *ChatGPTWebServer) httpServer(ctx context.Context) {
-	accountService, err := controllers.NewAccountService(r.DataBase, r.BasicAuthUser, r.BasicAuthPassword)
+func (r *ChatGPTWebServer) httpServer(ctx context.Context, store *configStore) {
+	cfg := store.Get()
+	users, passwords := cfg.staticUsers()
+	accountService, err := controllers.NewAccountService(cfg.Server.DB, users, passwords)
 	if err != nil {
 		klog.Fatal(err)
 	}
-	chatService, err := controllers.NewChatService(r.OpenAIKey, r.OpenAIBaseURL, r.SocksProxy, controllers.ChatCompletionParams{
-		Model:                 r.OpenAIModel,
-		MaxTokens:             r.OpenAIMaxTokens,
-		Temperature:           float32(r.OpenAITemperature) / 100.0,
-		PresencePenalty:       float32(r.OpenAIPresencePenalty) / 100.0,
-		FrequencyPenalty:      float32(r.OpenAIFrequencyPenalty) / 100.0,
-		ChatSessionTTL:        time.Duration(r.ChatSessionTTL) * time.Minute,
-		ChatMinResponseTokens: r.ChatMinResponseTokens,
-	}, accountService)
+	chatService, err := controllers.NewChatService(cfg.Provider.OpenAIKey, cfg.Provider.BaseURL, cfg.Provider.SocksProxy, cfg.chatParams(), accountService)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	// one limiter per route, as before, all following limits
+	limiters := []*rate.Limiter{}
+	chatLimit := func() gin.HandlerFunc {
+		limiter := rate.NewLimiter(rate.Limit(cfg.Limits.ChatRate), cfg.Limits.ChatBurst)
+		limiters = append(limiters, limiter)
+		return middlewares.RateLimiterMiddleware(limiter)
+	}
+	registerLimiter := middlewares.NewIPRateLimiter(rate.Limit(cfg.Limits.RegisterRate/60), cfg.Limits.RegisterBurst)
+	static := cfg
+	store.OnReload(func(cfg *Config) {
+		chatService.Reload(cfg.chatParams())
+		for _, limiter := range limiters {
+			limiter.SetLimit(rate.Limit(cfg.Limits.ChatRate))
+			limiter.SetBurst(cfg.Limits.ChatBurst)
+		}
+		registerLimiter.SetLimit(rate.Limit(cfg.Limits.RegisterRate/60), cfg.Limits.RegisterBurst)
+		users, passwords := cfg.staticUsers()
+		if err := accountService.SyncStaticUsers(users, passwords); err != nil {
+			klog.ErrorS(err, "reload static users error")
+		}
+		if removed := static.removedUsers(cfg); len(removed) > 0 {
+			klog.InfoS("demote removed static users", "users", removed)
+			if err := accountService.DemoteStaticUsers(removed); err != nil {
+				klog.ErrorS(err, "demote static users error")
+			}
+		}
+		static = cfg
+	})
+	// resets the plan allowances and expires the grants, stopped before the database is closed
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		accountService.RunScheduler(ctx)
+	}()
+	registry := commands.NewRegistry(Authenticate(accountService))
+	commands.RegisterBuiltin(registry, accountService, cfg.Server.OpsLink)
 
-	addr := fmt.Sprintf("%s:%d", r.Host, r.Port)
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	klog.Infof("ChatGPT Web Server on: %s", addr)
 	server := &http.Server{
 		Addr: addr,
 	}
 	entry, proxy := gin.New(), gin.New()
-	entry.Use(gin.Logger())
+	// handlers pass the gin context on, so it must expose the request id of the request context
+	entry.ContextWithFallback = true
+	entry.Use(middlewares.RequestID())
+	entry.Use(middlewares.Tracing())
+	entry.Use(middlewares.Logger())
 	entry.Use(gin.Recovery())
 	chat := entry.Group("/api")
-	chat.POST("/chat-process", BasicAuth(accountService, r.OpsLink), middlewares.RateLimitMiddleware(1, 2), chatService.ChatProcess)
+	chat.POST("/chat-process", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatLimit(), chatService.ChatProcess)
+	chat.POST("/chat-process/regenerate", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatLimit(), chatService.ChatRegenerate)
+	chat.POST("/chat-process/edit", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatLimit(), chatService.ChatEdit)
+	chat.POST("/chat-process/:id/cancel", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatCancel)
+	chat.POST("/chat-process/:id/resume", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatResume)
+	chat.POST("/images", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatUploadImage)
+	chat.POST("/documents", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.DocumentUpload)
+	chat.GET("/documents", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.DocumentList)
+	chat.DELETE("/documents/:id", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.DocumentDelete)
+	chat.GET("/conversations/:id/siblings", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatSiblings)
+	chat.POST("/conversations/:id/activate", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatActivate)
+	chat.GET("/conversations/:id/export", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatExport)
+	chat.POST("/conversations/import", BasicAuth(accountService, registry, cfg.Server.OpsLink), chatService.ChatImport)
+	chat.POST("/register", registerLimiter.Middleware(), accountService.RegisterProcess(commands.CheckAccountAndPassword))
+	chat.POST("/redeem", BasicAuth(accountService, registry, cfg.Server.OpsLink), accountService.RedeemProcess)
 	chat.POST("/config", func(ctx *gin.Context) {
 		ctx.JSON(200, gin.H{
 			"status": "Success",
 			"data": map[string]string{
 				"apiModel":   "ChatGPTAPI",
-				"socksProxy": r.SocksProxy,
+				"socksProxy": cfg.Provider.SocksProxy,
 			},
 		})
 	})
@@ -108,23 +217,26 @@ func (r *ChatGPTWebServer) httpServer(ctx context.Context) {
 			},
 		})
 	})
-	entry.POST("/accounts", OpsAuth(r.OpsKey), accountService.AccountProcess)
-	entry.Any("/admin/*relativePath", gin.BasicAuth(gin.Accounts{"admin": r.OpsKey}), func(ctx *gin.Context) {
+	entry.POST("/accounts", OpsAuth(cfg.Server.OpsKey), accountService.AccountProcess)
+	entry.GET("/ops/cache", OpsAuth(cfg.Server.OpsKey), chatService.CacheStats)
+	entry.GET("/ops/vouchers.csv", OpsAuth(cfg.Server.OpsKey), accountService.VoucherExport)
+	entry.GET("/ops/config", OpsAuth(cfg.Server.OpsKey), store.Handler)
+	entry.Any("/admin/*relativePath", gin.BasicAuth(gin.Accounts{"admin": cfg.Server.OpsKey}), func(ctx *gin.Context) {
 		if ctx.Request.URL.Path == "/admin/accounts" {
 			accountService.AccountProcess(ctx)
 		} else {
-			http.FileServer(http.Dir(path.Join(r.FrontendPath))).ServeHTTP(ctx.Writer, ctx.Request)
+			http.FileServer(http.Dir(path.Join(cfg.Server.FrontendPath))).ServeHTTP(ctx.Writer, ctx.Request)
 		}
 	})
-	if r.OpenAIProxy {
+	if cfg.Provider.Proxy {
 		klog.Info("enable proxy openai api server")
-		upstreamURL, err := url.Parse(strings.TrimSuffix(r.OpenAIBaseURL, "/v1"))
+		upstreamURL, err := url.Parse(strings.TrimSuffix(cfg.Provider.BaseURL, "/v1"))
 		if err != nil {
 			klog.Fatal(err)
 		}
 		upstream := httputil.NewSingleHostReverseProxy(upstreamURL)
-		if r.SocksProxy != "" {
-			proxyUrl, err := url.Parse(r.SocksProxy)
+		if cfg.Provider.SocksProxy != "" {
+			proxyUrl, err := url.Parse(cfg.Provider.SocksProxy)
 			if err != nil {
 				klog.Fatal(err)
 			}
@@ -138,44 +250,56 @@ func (r *ChatGPTWebServer) httpServer(ctx context.Context) {
 			upstream.ServeHTTP(ctx.Writer, ctx.Request)
 		})
 		proxy.NoRoute(func(ctx *gin.Context) {
-			http.FileServer(http.Dir(r.FrontendPath)).ServeHTTP(ctx.Writer, ctx.Request)
+			http.FileServer(http.Dir(cfg.Server.FrontendPath)).ServeHTTP(ctx.Writer, ctx.Request)
 		})
 		entry.NoRoute(func(ctx *gin.Context) {
 			proxy.ServeHTTP(ctx.Writer, ctx.Request)
 		})
 	} else {
 		entry.NoRoute(func(ctx *gin.Context) {
-			http.FileServer(http.Dir(r.FrontendPath)).ServeHTTP(ctx.Writer, ctx.Request)
+			http.FileServer(http.Dir(cfg.Server.FrontendPath)).ServeHTTP(ctx.Writer, ctx.Request)
 		})
 	}
 
 	server.Handler = entry
-	go func(ctx context.Context) {
-		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("Server shutdown with error %v", err)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Server listen and serve error %v", err)
 		}
-	}(ctx)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Server listen and serve error %v", err)
-	}
+	}()
+	<-ctx.Done()
+	<-schedulerDone
+	shutdown(server, chatService, accountService, time.Duration(cfg.Server.ShutdownTimeout)*time.Second)
 }
 
-func (r *ChatGPTWebServer) startTokenizer(ctx context.Context) {
-	args := strings.Split("nuxt --module tokenizer.py --workers 2", " ")
-	klog.Infof("Start Tokenizer with %v", args)
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
-		klog.Error(err)
-		os.Exit(1)
+// shutdown stops accepting requests and chats, waits for the requests and the completions in flight
+// until the timeout, then closes the database once the replies are stored and billed
+func shutdown(server *http.Server, chatService *controllers.ChatService, accountService *controllers.AccountService, timeout time.Duration) {
+	klog.InfoS("shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := chatService.Drain(ctx); err != nil {
+			klog.ErrorS(err, "drain chats error")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := server.Shutdown(ctx); err != nil {
+			klog.ErrorS(err, "server shutdown error")
+			server.Close()
+		}
+	}()
+	wg.Wait()
+	if err := accountService.Close(); err != nil {
+		klog.ErrorS(err, "close database error")
 	}
 }
 
-func (r *ChatGPTWebServer) updateAssetsFiles(link string) error {
+func (r *ChatGPTWebServer) updateAssetsFiles(frontendPath, link string) error {
 	pairs := map[string]string{}
 	old := `{avatar:"https://raw.githubusercontent.com/Chanzhaoyu/chatgpt-web/main/src/assets/avatar.jpg",name:"ChenZhaoYu",description:'Star on <a href="https://github.com/Chanzhaoyu/chatgpt-bot" class="text-blue-500" target="_blank" >Github</a>'}`
 	new := fmt.Sprintf(`{avatar:"https://raw.githubusercontent.com/Chanzhaoyu/chatgpt-web/main/src/assets/avatar.jpg",name:"获取帮助输入/help",description:'<a href="%s" class="text-blue-500" target="_blank" >自助中心</a>'}`, link)
@@ -189,7 +313,7 @@ func (r *ChatGPTWebServer) updateAssetsFiles(link string) error {
 	old = `[y(" 此项目开源于 "),e("a",{class:"text-blue-600 dark:text-blue-500",href:"https://github.com/Chanzhaoyu/chatgpt-web",target:"_blank"}," Github "),y(" ，免费且基于 MIT 协议，没有任何形式的付费行为！ ")]`
 	new = `[y(" 此项目开源于 "),e("a",{class:"text-blue-600 dark:text-blue-500",href:"https://github.com/Arvintian/chatgpt-web",target:"_blank"}," Github ")]`
 	pairs[old] = new
-	return utils.ReplaceFiles(r.FrontendPath, pairs)
+	return utils.ReplaceFiles(frontendPath, pairs)
 }
 
 func (r *ChatGPTWebServer) ShowVersion() error {
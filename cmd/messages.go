@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+)
+
+func init() {
+	i18n.Register(i18n.ZhCN, map[string]string{
+		"auth.internal.error": "内部错误",
+		"auth.invalid.key":    "API Key无效",
+		"auth.unauthorized":   "账号未授权,请输入/login登录其他账户",
+		"auth.exhausted":      "Token数已用尽,请到[自助中心](%s)补充,您的账号: %s",
+		"auth.ops.key":        "Header Opskey error",
+	})
+	i18n.Register(i18n.En, map[string]string{
+		"auth.internal.error": "Internal error",
+		"auth.invalid.key":    "Invalid API key",
+		"auth.unauthorized":   "Account not authorized, enter /login to log in with another account",
+		"auth.exhausted":      "Tokens used up, top up at the [self-service center](%s), your account: %s",
+		"auth.ops.key":        "Header Opskey error",
+	})
+}
@@ -0,0 +1,125 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+	"github.com/gin-gonic/gin"
+)
+
+type Code string
+
+const (
+	InvalidRequest Code = "invalid_request"
+	AuthFailed     Code = "auth_failed"
+	QuotaExhausted Code = "quota_exhausted"
+	NotFound       Code = "not_found"
+	Conflict       Code = "conflict"
+	ContextTooLong Code = "context_too_long"
+	ContentFlagged Code = "content_flagged"
+	RateLimited    Code = "rate_limited"
+	InternalError  Code = "internal_error"
+	UpstreamError  Code = "upstream_error"
+	Unavailable    Code = "unavailable"
+)
+
+var statuses = map[Code]int{
+	InvalidRequest: http.StatusBadRequest,
+	AuthFailed:     http.StatusUnauthorized,
+	QuotaExhausted: http.StatusPaymentRequired,
+	NotFound:       http.StatusNotFound,
+	Conflict:       http.StatusConflict,
+	ContextTooLong: http.StatusBadRequest,
+	ContentFlagged: http.StatusBadRequest,
+	RateLimited:    http.StatusTooManyRequests,
+	InternalError:  http.StatusInternalServerError,
+	UpstreamError:  http.StatusBadGateway,
+	Unavailable:    http.StatusServiceUnavailable,
+}
+
+func (code Code) Status() int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error gives err a code, the message is still taken from err
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func New(code Code, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// Errorf is New with a catalog message
+func Errorf(code Code, key string, args ...interface{}) error {
+	return &Error{Code: code, Err: i18n.Errorf(key, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// CodeOf returns the code of err, errors without one are internal
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return InternalError
+}
+
+// Typed reports whether the request gets the typed envelope with the HTTP status of the code,
+// API clients using a bearer key or the ops key get it by default, the bundled frontends
+// only understand the legacy envelope which is always sent with HTTP 200
+func Typed(c *gin.Context) bool {
+	switch c.GetHeader("X-Error-Format") {
+	case "typed":
+		return true
+	case "legacy":
+		return false
+	}
+	return strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") || c.GetHeader("Opskey") != ""
+}
+
+// Fail writes err in the envelope of the request:
+// {"status":"Fail","message":"...","data":null} and with the typed format also "code":"..."
+func Fail(c *gin.Context, err error) {
+	message := i18n.Message(i18n.Lang(c), err)
+	code := CodeOf(err)
+	c.Set("error_code", string(code))
+	if !Typed(c) {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "Fail",
+			"message": message,
+			"data":    nil,
+		})
+		return
+	}
+	status := code.Status()
+	if c.Writer.Written() {
+		// a stream already sent its status, only the body can tell the error
+		status = c.Writer.Status()
+	}
+	c.JSON(status, gin.H{
+		"status":  "Fail",
+		"code":    code,
+		"message": message,
+		"data":    nil,
+	})
+}
+
+// Abort is Fail followed by aborting the handler chain
+func Abort(c *gin.Context, err error) {
+	Fail(c, err)
+	c.Abort()
+}
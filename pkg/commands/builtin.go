@@ -0,0 +1,290 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Arvintian/chatgpt-web/pkg/controllers"
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+)
+
+const (
+	SystemMaxLength = 2000
+	UsageDays       = 30
+)
+
+// RegisterBuiltin adds the default commands, link is the self-service center shown in /help
+func RegisterBuiltin(r *Registry, ac *controllers.AccountService, link string) {
+	r.Register(&Command{
+		Name: "help",
+		Help: "cmd.help.desc",
+		Auth: AuthNone,
+		Run: func(c *Context) {
+			var message strings.Builder
+			message.WriteString(c.T("cmd.help.title"))
+			for _, command := range r.Commands() {
+				message.WriteString(fmt.Sprintf("\n- %s %s", r.Syntax(command, c.Locale), c.T(command.Help)))
+			}
+			message.WriteString("\n\n" + c.T("cmd.help.footer", link) + "\n")
+			c.Reply(message.String())
+		},
+	})
+	r.Register(&Command{
+		Name: "me",
+		Help: "cmd.me.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			allowance, err := ac.WithContext(c.Gin).AllowanceOf(c.User)
+			if err != nil {
+				c.Reply(c.Message(err))
+				return
+			}
+			remaining := c.User.Balance - c.User.Usage
+			if !allowance.Unlimited {
+				remaining = allowance.Remaining()
+			}
+			message := c.T("cmd.me.info", c.User.Username, remaining)
+			if allowance.Plan != "" {
+				message += c.T("cmd.me.plan", allowance.Plan, allowance.PlanLeft, allowance.Reset.Format("2006-01-02 15:04"))
+			}
+			if allowance.Grants > 0 {
+				message += c.T("cmd.me.grants", allowance.Grants)
+			}
+			if c.User.Model != "" {
+				message += c.T("cmd.me.model", c.User.Model)
+			}
+			if c.User.Models != "" {
+				message += c.T("cmd.me.models", c.User.Models)
+			}
+			if c.User.System != "" {
+				message += c.T("cmd.me.system", c.User.System)
+			}
+			c.Reply(message)
+		},
+	})
+	r.Register(&Command{
+		Name: "model",
+		Args: []Arg{{Name: "config", Type: Text, Optional: true, Label: "cmd.model.arg"}},
+		Help: "cmd.model.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			model := c.String("config")
+			if model == "-" {
+				model = ""
+			}
+			if name := strings.SplitN(model, ",", 2)[0]; name != "" && !c.User.AllowsModel(name) {
+				c.Reply(c.T("cmd.model.not.allowed", name, c.User.Models))
+				return
+			}
+			if err := ac.UpdateModel(c.User.Username, model); err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			c.Reply(c.T("cmd.updated"))
+		},
+	})
+	r.Register(&Command{
+		Name: "user",
+		Args: []Arg{{Name: "credentials", Type: Text, Label: "cmd.user.arg"}},
+		Help: "cmd.user.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			name, passwd, err := ExtractAccountAndPassword("/user " + c.String("credentials"))
+			if err != nil {
+				c.Reply(c.T("cmd.user.invalid", c.Message(err)))
+				return
+			}
+			if err := ac.UpdateUser(c.User.Username, c.User.Password, name, passwd); err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			c.Reply(c.T("cmd.user.done"))
+		},
+	})
+	r.Register(&Command{
+		Name: "login",
+		Help: "cmd.login.desc",
+		Auth: AuthNone,
+		Run: func(c *Context) {
+			// the cookie makes the next /login answer normally after the browser asked for credentials
+			if _, err := c.Gin.Request.Cookie("dologin"); err != nil {
+				c.Gin.Header("WWW-Authenticate", "Basic realm=\"Restricted\"")
+				http.SetCookie(c.Gin.Writer, &http.Cookie{
+					Name:    "dologin",
+					Value:   "yes",
+					Expires: time.Now().Add(24 * time.Hour),
+					Path:    "/",
+				})
+				c.Gin.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			http.SetCookie(c.Gin.Writer, &http.Cookie{
+				Name:   "dologin",
+				Value:  "yes",
+				MaxAge: -1,
+				Path:   "/",
+			})
+			c.Reply(c.T("cmd.login.done"))
+		},
+	})
+	r.Register(&Command{
+		Name: "lang",
+		Args: []Arg{{Name: "locale", Type: String, Optional: true, Label: "cmd.lang.arg"}},
+		Help: "cmd.lang.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			locale := c.String("locale")
+			if locale == "-" {
+				locale = ""
+			} else if locale = i18n.Supported(locale); locale == "" {
+				c.Reply(c.T("cmd.syntax", r.Syntax(r.commands["lang"], c.Locale)))
+				return
+			}
+			if err := ac.UpdateLocale(c.User.Username, locale); err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			c.Locale = i18n.Preferred(locale, c.Gin.Request.Header.Get("Accept-Language"))
+			c.Reply(c.T("cmd.updated"))
+		},
+	})
+	r.Register(&Command{
+		Name: "system",
+		Args: []Arg{{Name: "prompt", Type: Text, Optional: true, Label: "cmd.system.arg"}},
+		Help: "cmd.system.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			if !c.Has("prompt") {
+				if c.User.System == "" {
+					c.Reply(c.T("cmd.system.empty"))
+				} else {
+					c.Reply(c.T("cmd.system.current", c.User.System))
+				}
+				return
+			}
+			system := c.String("prompt")
+			if system == "-" {
+				system = ""
+			}
+			if utf8.RuneCountInString(system) > SystemMaxLength {
+				c.Reply(c.T("cmd.system.long", SystemMaxLength))
+				return
+			}
+			if err := ac.UpdateSystem(c.User.Username, system); err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			c.Reply(c.T("cmd.updated"))
+		},
+	})
+	r.Register(&Command{
+		Name: "reset",
+		Help: "cmd.reset.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			if err := ac.UpdateModel(c.User.Username, ""); err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			if err := ac.UpdateSystem(c.User.Username, ""); err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			c.Reply(c.T("cmd.reset.done"))
+		},
+	})
+	r.Register(&Command{
+		Name: "usage",
+		Help: "cmd.usage.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			summary, err := ac.UsageSummary(c.User.Username, time.Now().AddDate(0, 0, -UsageDays))
+			if err != nil {
+				c.Reply(c.Message(err))
+				return
+			}
+			if len(summary) == 0 {
+				c.Reply(c.T("cmd.usage.empty", UsageDays))
+				return
+			}
+			message := c.T("cmd.usage.title", UsageDays)
+			for _, item := range summary {
+				message += c.T("cmd.usage.row", item.Model, item.PromptTokens, item.CompletionTokens, item.Requests)
+			}
+			c.Reply(message)
+		},
+	})
+	r.Register(&Command{
+		Name: "keys",
+		Args: []Arg{{Name: "action", Type: String, Optional: true}, {Name: "prefix", Type: String, Optional: true}},
+		Help: "cmd.keys.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			switch c.String("action") {
+			case "":
+				keys, err := ac.ListAPIKeys(c.User.Username)
+				if err != nil {
+					c.Reply(c.Message(err))
+					return
+				}
+				if len(keys) == 0 {
+					c.Reply(c.T("cmd.keys.empty"))
+					return
+				}
+				message := c.T("cmd.keys.title")
+				for _, key := range keys {
+					message += c.T("cmd.keys.row", key.Prefix, key.CreatedAt.Format("2006-01-02 15:04"))
+				}
+				c.Reply(message)
+			case "new":
+				key, err := ac.CreateAPIKey(c.User.Username)
+				if err != nil {
+					c.Reply(c.T("cmd.update.failed", c.Message(err)))
+					return
+				}
+				c.Reply(c.T("cmd.keys.created", key))
+			case "revoke":
+				prefix := strings.TrimSuffix(c.String("prefix"), "...")
+				if prefix == "" {
+					c.Reply(c.T("cmd.syntax", r.Syntax(r.commands["keys"], c.Locale)))
+					return
+				}
+				if err := ac.RevokeAPIKey(c.User.Username, prefix); err != nil {
+					c.Reply(c.T("cmd.update.failed", c.Message(err)))
+					return
+				}
+				c.Reply(c.T("cmd.keys.revoked", prefix))
+			default:
+				c.Reply(c.T("cmd.syntax", r.Syntax(r.commands["keys"], c.Locale)))
+			}
+		},
+	})
+	r.Register(&Command{
+		Name: "redeem",
+		Args: []Arg{{Name: "code", Type: Text, Label: "cmd.redeem.arg"}},
+		Help: "cmd.redeem.desc",
+		Auth: AuthUser,
+		Run: func(c *Context) {
+			ac := ac.WithContext(c.Gin)
+			voucher, err := ac.Redeem(c.User.Username, c.String("code"))
+			if err != nil {
+				c.Reply(c.T("cmd.update.failed", c.Message(err)))
+				return
+			}
+			user, err := ac.CheckUser(c.User.Username)
+			if err != nil {
+				c.Reply(c.Message(err))
+				return
+			}
+			allowance, err := ac.AllowanceOf(user)
+			if err != nil {
+				c.Reply(c.Message(err))
+				return
+			}
+			c.Reply(c.T("cmd.redeem.done", voucher.Amount, allowance.Remaining()))
+		},
+	})
+}
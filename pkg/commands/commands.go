@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Arvintian/chatgpt-web/pkg/controllers"
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+	"github.com/gin-gonic/gin"
+)
+
+var ErrNoCredentials = errors.New("no credentials")
+
+type Auth int
+
+const (
+	AuthNone Auth = iota // anyone can run the command, Context.User is set when the credentials are valid
+	AuthUser             // the request must carry valid credentials, Context.User is set
+)
+
+type ArgType int
+
+const (
+	String ArgType = iota // one word
+	Int                   // one integer
+	Text                  // the rest of the line
+)
+
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	Label    string // catalog key shown in help, Name when empty
+}
+
+type Command struct {
+	Name string
+	Args []Arg
+	Help string // catalog key of the description
+	Auth Auth
+	Run  func(c *Context)
+}
+
+type Context struct {
+	Gin    *gin.Context
+	Locale string
+	User   controllers.User
+	args   map[string]interface{}
+}
+
+func (c *Context) T(key string, args ...interface{}) string {
+	return i18n.T(c.Locale, key, args...)
+}
+
+// Reply answers the command in the chat, the Fail status makes the frontend show the message as is
+func (c *Context) Reply(message string) {
+	c.Gin.JSON(http.StatusOK, gin.H{
+		"status":  "Fail",
+		"message": message,
+		"data":    nil,
+	})
+}
+
+// Message is the text of err in the locale of the command
+func (c *Context) Message(err error) string {
+	return i18n.Message(c.Locale, err)
+}
+
+func (c *Context) String(name string) string {
+	value, _ := c.args[name].(string)
+	return value
+}
+
+func (c *Context) Int(name string) int {
+	value, _ := c.args[name].(int)
+	return value
+}
+
+func (c *Context) Has(name string) bool {
+	_, ok := c.args[name]
+	return ok
+}
+
+type Registry struct {
+	commands     map[string]*Command
+	order        []string
+	authenticate func(c *gin.Context) (controllers.User, error)
+}
+
+// NewRegistry creates an empty registry, authenticate resolves the user of a request or returns ErrNoCredentials
+func NewRegistry(authenticate func(c *gin.Context) (controllers.User, error)) *Registry {
+	return &Registry{
+		commands:     map[string]*Command{},
+		authenticate: authenticate,
+	}
+}
+
+func (r *Registry) Register(command *Command) {
+	if _, ok := r.commands[command.Name]; !ok {
+		r.order = append(r.order, command.Name)
+	}
+	r.commands[command.Name] = command
+}
+
+// Commands returns the commands in registration order
+func (r *Registry) Commands() []*Command {
+	commands := make([]*Command, 0, len(r.order))
+	for _, name := range r.order {
+		commands = append(commands, r.commands[name])
+	}
+	return commands
+}
+
+// Syntax is the usage line of a command such as /model [config]
+func (r *Registry) Syntax(command *Command, locale string) string {
+	parts := []string{"/" + command.Name}
+	for _, arg := range command.Args {
+		label := arg.Name
+		if arg.Label != "" {
+			label = i18n.T(locale, arg.Label)
+		}
+		if arg.Optional {
+			parts = append(parts, "["+label+"]")
+		} else {
+			parts = append(parts, "<"+label+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Dispatch runs the command of prompt and reports whether the prompt was a registered command
+func (r *Registry) Dispatch(c *gin.Context, prompt string) bool {
+	fields := strings.Fields(prompt)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return false
+	}
+	command, ok := r.commands[strings.TrimPrefix(fields[0], "/")]
+	if !ok {
+		return false
+	}
+	// the user is resolved for every command so replies follow the language preference
+	user, err := r.authenticate(c)
+	ctx := &Context{
+		Gin:    c,
+		Locale: i18n.Preferred(user.Locale, c.Request.Header.Get("Accept-Language")),
+		User:   user,
+		args:   map[string]interface{}{},
+	}
+	if command.Auth == AuthUser {
+		if errors.Is(err, ErrNoCredentials) {
+			ctx.Reply(ctx.T("cmd.not.login"))
+			return true
+		}
+		if err != nil {
+			ctx.Reply(ctx.T("cmd.bad.user"))
+			return true
+		}
+	}
+	if err := r.parse(command, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(prompt), fields[0])), ctx); err != nil {
+		ctx.Reply(ctx.T("cmd.syntax", r.Syntax(command, ctx.Locale)))
+		return true
+	}
+	command.Run(ctx)
+	return true
+}
+
+func (r *Registry) parse(command *Command, rest string, ctx *Context) error {
+	for _, arg := range command.Args {
+		if rest == "" {
+			if !arg.Optional {
+				return errors.New("missing argument " + arg.Name)
+			}
+			continue
+		}
+		if arg.Type == Text {
+			ctx.args[arg.Name] = rest
+			rest = ""
+			continue
+		}
+		word := rest
+		if i := strings.IndexAny(rest, " \t\n"); i >= 0 {
+			word, rest = rest[:i], strings.TrimSpace(rest[i:])
+		} else {
+			rest = ""
+		}
+		switch arg.Type {
+		case Int:
+			value, err := strconv.Atoi(word)
+			if err != nil {
+				return err
+			}
+			ctx.args[arg.Name] = value
+		default:
+			ctx.args[arg.Name] = word
+		}
+	}
+	if rest != "" {
+		return errors.New("too many arguments")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+)
+
+func init() {
+	i18n.Register(i18n.ZhCN, map[string]string{
+		"account.invalid":       "账户不合法",
+		"password.invalid":      "密码不合法",
+		"credentials.invalid":   "账户密码格式不正确",
+		"cmd.not.login":         "未登录",
+		"cmd.bad.user":          "当前用户信息错误,请输入/login登录其他账户",
+		"cmd.syntax":            "用法: %s",
+		"cmd.updated":           "更新成功",
+		"cmd.update.failed":     "更新失败:%v",
+		"cmd.help.title":        "#### 帮助命令",
+		"cmd.help.footer":       "[自助中心](%s)",
+		"cmd.help.desc":         "获取帮助信息",
+		"cmd.me.desc":           "获取用户信息、Token余额",
+		"cmd.me.info":           "账户: %s\nToken余额: %d",
+		"cmd.me.model":          "\n模型配置: %s",
+		"cmd.me.models":         "\n可用模型: %s",
+		"cmd.me.plan":           "\n套餐%s: 本期剩余%d,%s重置",
+		"cmd.me.grants":         "\n赠送Token: %d",
+		"cmd.me.system":         "\n系统提示词: %s",
+		"cmd.model.desc":        "设置使用模型, -恢复默认",
+		"cmd.model.arg":         "model_name,temperature,presence,frequency,max_tokens",
+		"cmd.model.not.allowed": "不能使用模型%s,可用模型: %s",
+		"cmd.user.desc":         "更改账户、密码",
+		"cmd.user.arg":          "新账户:新密码",
+		"cmd.user.invalid":      "%v\n\n账户格式:大小写字母和数字4-12位,必须字母开头\n密码格式:大小写字母和数字6-12位",
+		"cmd.user.done":         "更新成功,请输入/login重新登录",
+		"cmd.login.desc":        "登录、重新登录",
+		"cmd.login.done":        "登录成功",
+		"cmd.usage.desc":        "查看近30天Token使用量",
+		"cmd.usage.title":       "近%d天Token使用量:",
+		"cmd.usage.row":         "\n- %s: 输入%d, 输出%d, 共%d次请求",
+		"cmd.usage.empty":       "近%d天没有使用记录",
+		"cmd.lang.desc":         "设置回复语言, -跟随浏览器",
+		"cmd.lang.arg":          "zh-CN|en",
+		"cmd.system.desc":       "查看、设置系统提示词, -清除",
+		"cmd.system.arg":        "提示词",
+		"cmd.system.empty":      "未设置系统提示词",
+		"cmd.system.current":    "系统提示词: %s",
+		"cmd.system.long":       "系统提示词不能超过%d字",
+		"cmd.reset.desc":        "重置模型配置和系统提示词",
+		"cmd.reset.done":        "已重置模型配置和系统提示词",
+		"cmd.keys.desc":         "管理API Key: new 新建, revoke 前缀 删除",
+		"cmd.keys.arg":          "new|revoke 前缀",
+		"cmd.keys.created":      "新的API Key,只显示一次,请妥善保存:\n\n`%s`\n\n使用方式: 请求头 Authorization: Bearer <API Key>",
+		"cmd.keys.empty":        "没有API Key,输入/keys new新建",
+		"cmd.keys.title":        "API Key列表:",
+		"cmd.keys.row":          "\n- `%s...` 创建于 %s",
+		"cmd.keys.revoked":      "已删除API Key %s",
+		"cmd.redeem.desc":       "使用充值卡充值Token",
+		"cmd.redeem.arg":        "充值卡号",
+		"cmd.redeem.done":       "充值成功,增加%d Token,当前余额%d",
+	})
+	i18n.Register(i18n.En, map[string]string{
+		"account.invalid":       "Invalid account",
+		"password.invalid":      "Invalid password",
+		"credentials.invalid":   "Invalid account:password format",
+		"cmd.not.login":         "Not logged in",
+		"cmd.bad.user":          "Invalid current user, enter /login to log in with another account",
+		"cmd.syntax":            "Usage: %s",
+		"cmd.updated":           "Updated",
+		"cmd.update.failed":     "Update failed: %v",
+		"cmd.help.title":        "#### Commands",
+		"cmd.help.footer":       "[Self-service center](%s)",
+		"cmd.help.desc":         "Show this help",
+		"cmd.me.desc":           "Show the account and token balance",
+		"cmd.me.info":           "Account: %s\nToken balance: %d",
+		"cmd.me.model":          "\nModel config: %s",
+		"cmd.me.models":         "\nAllowed models: %s",
+		"cmd.me.plan":           "\nPlan %s: %d left in this period, reset at %s",
+		"cmd.me.grants":         "\nTop-up grants: %d",
+		"cmd.me.system":         "\nSystem prompt: %s",
+		"cmd.model.desc":        "Set the model, - restores the default",
+		"cmd.model.arg":         "model_name,temperature,presence,frequency,max_tokens",
+		"cmd.model.not.allowed": "Model %s is not allowed, allowed models: %s",
+		"cmd.user.desc":         "Change account and password",
+		"cmd.user.arg":          "new_account:new_password",
+		"cmd.user.invalid":      "%v\n\nAccount: 4-12 letters and digits starting with a letter\nPassword: 6-12 letters and digits",
+		"cmd.user.done":         "Updated, enter /login to log in again",
+		"cmd.login.desc":        "Log in or switch account",
+		"cmd.login.done":        "Logged in",
+		"cmd.usage.desc":        "Show token usage of the last 30 days",
+		"cmd.usage.title":       "Token usage of the last %d days:",
+		"cmd.usage.row":         "\n- %s: prompt %d, completion %d, %d requests",
+		"cmd.usage.empty":       "No usage in the last %d days",
+		"cmd.lang.desc":         "Set the reply language, - follows the browser",
+		"cmd.lang.arg":          "zh-CN|en",
+		"cmd.system.desc":       "Show or set the system prompt, - clears it",
+		"cmd.system.arg":        "prompt",
+		"cmd.system.empty":      "No system prompt set",
+		"cmd.system.current":    "System prompt: %s",
+		"cmd.system.long":       "The system prompt can not be longer than %d characters",
+		"cmd.reset.desc":        "Reset the model config and system prompt",
+		"cmd.reset.done":        "Model config and system prompt reset",
+		"cmd.keys.desc":         "Manage API keys: new creates one, revoke prefix deletes one",
+		"cmd.keys.arg":          "new|revoke prefix",
+		"cmd.keys.created":      "New API key, it is shown only once:\n\n`%s`\n\nUse it with the header Authorization: Bearer <API key>",
+		"cmd.keys.empty":        "No API keys, enter /keys new to create one",
+		"cmd.keys.title":        "API keys:",
+		"cmd.keys.row":          "\n- `%s...` created at %s",
+		"cmd.keys.revoked":      "API key %s deleted",
+		"cmd.redeem.desc":       "Top up tokens with a voucher",
+		"cmd.redeem.arg":        "voucher code",
+		"cmd.redeem.done":       "Redeemed %d tokens, the balance is %d",
+	})
+}
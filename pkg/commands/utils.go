@@ -1,8 +1,9 @@
-package main
+package commands
 
 import (
-	"errors"
 	"regexp"
+
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
 )
 
 // ExtractAccountAndPassword 从字符串中提取账户密码并校验
@@ -16,18 +17,25 @@ func ExtractAccountAndPassword(str string) (account, password string, err error)
 		password = result[2]
 
 		// 校验账户和密码
-		if !checkAccount(account) {
-			err = errors.New("账户不合法")
-		} else if !checkPassword(password) {
-			err = errors.New("密码不合法")
-		}
+		err = CheckAccountAndPassword(account, password)
 	} else {
-		err = errors.New("账户密码格式不正确")
+		err = i18n.Errorf("credentials.invalid")
 	}
 
 	return
 }
 
+// CheckAccountAndPassword 校验账户密码,规则与/user命令相同
+func CheckAccountAndPassword(account, password string) error {
+	if !checkAccount(account) {
+		return i18n.Errorf("account.invalid")
+	}
+	if !checkPassword(password) {
+		return i18n.Errorf("password.invalid")
+	}
+	return nil
+}
+
 // 校验账户
 func checkAccount(account string) bool {
 	pattern := `^[a-zA-Z][a-zA-Z0-9]{3,11}$`
@@ -1,16 +1,20 @@
 package controllers
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
 	"github.com/gin-gonic/gin"
 	"github.com/glebarez/sqlite"
 	mmysql "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"k8s.io/klog/v2"
 )
 
@@ -25,57 +29,138 @@ type User struct {
 	Balance  int64  `gorm:"column:balance;not null;default:0"`
 	Usage    int64  `gorm:"column:usage;not null;default:0"`
 	Model    string `gorm:"column:model;not null;default:''"` // model_name,temperature,presence,frequency,max_tokens
+	System   string `gorm:"column:system;type:varchar(2000);not null;default:''"`
+	Locale   string `gorm:"column:locale;type:varchar(16);not null;default:''"`   // preferred message language, empty follows Accept-Language
+	Models   string `gorm:"column:models;type:varchar(1000);not null;default:''"` // allowed models, comma separated, empty allows all
 	Isblock  int    `gorm:"column:is_block;not null;default:0"`
+
+	PlanID      int64      `gorm:"column:plan_id;not null;default:0;index"` // 0 without a plan
+	PeriodStart *time.Time `gorm:"column:period_start"`
+	PeriodUsage int64      `gorm:"column:period_usage;not null;default:0"` // usage charged to the plan in the period
 }
 
 func (User) TableName() string {
 	return "users"
 }
 
-func NewAccountService(dsn string, basicUsers, baiscPasswords string) (*AccountService, error) {
-	accounts := map[string]string{}
-	users := strings.Split(basicUsers, ",")
-	passwords := strings.Split(baiscPasswords, ",")
-	if len(users) != len(passwords) {
-		return nil, errors.New("basic auth setting error")
+// AllowsModel reports whether the allowlist of the user has model
+func (user User) AllowsModel(model string) bool {
+	if user.Models == "" {
+		return true
 	}
-	for i := 0; i < len(users); i++ {
-		if len(users[i]) > 0 {
-			accounts[users[i]] = passwords[i]
+	for _, item := range strings.Split(user.Models, ",") {
+		if strings.TrimSpace(item) == model {
+			return true
 		}
 	}
+	return false
+}
+
+func NewAccountService(dsn string, basicUsers, baiscPasswords string) (*AccountService, error) {
 	var db *gorm.DB
 	_, err := mmysql.ParseDSN(dsn)
 	if err != nil {
-		db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+		db, err = gorm.Open(sqlite.Open(sqliteDSN(dsn)), &gorm.Config{})
 	} else {
 		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
 	}
 	if err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(&User{}); err != nil {
+	if err := db.Use(tracing.GormPlugin{}); err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&User{}, &UsageRecord{}, &Document{}, &DocumentChunk{}, &APIKey{}, &ModerationEvent{}, &InviteCode{}, &Voucher{}, &Plan{}, &Grant{}); err != nil {
 		return nil, err
 	}
 	as := &AccountService{
 		db: db,
 	}
-	//init static user
+	if err := as.SyncStaticUsers(basicUsers, baiscPasswords); err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+// sqliteDSN begins the transactions with the write lock and waits for it, a transaction reading
+// a row and then updating it would otherwise fail with SQLITE_BUSY under concurrent chats
+func sqliteDSN(dsn string) string {
+	params := []string{}
+	if !strings.Contains(dsn, "_txlock=") {
+		params = append(params, "_txlock=immediate")
+	}
+	if !strings.Contains(dsn, "busy_timeout") {
+		params = append(params, "_pragma=busy_timeout(5000)")
+	}
+	if len(params) == 0 {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + strings.Join(params, "&")
+}
+
+// SyncStaticUsers creates the static users or resets them to unlimited, both lists are comma separated
+func (ac *AccountService) SyncStaticUsers(basicUsers, baiscPasswords string) error {
+	accounts := map[string]string{}
+	users := strings.Split(basicUsers, ",")
+	passwords := strings.Split(baiscPasswords, ",")
+	if len(users) != len(passwords) {
+		return errors.New("basic auth setting error")
+	}
+	for i := 0; i < len(users); i++ {
+		if len(users[i]) > 0 {
+			accounts[users[i]] = passwords[i]
+		}
+	}
 	for user, passwd := range accounts {
-		item, err := as.GetUser(user, passwd)
-		if err != nil {
-			klog.Infof("create user %s:%s", user, passwd)
-			if err := as.CreateUser(user, passwd, -1); err != nil {
-				return nil, err
-			}
-		} else {
-			item.Balance, item.Isblock = -1, 0
-			if err := db.Save(&item).Error; err != nil {
-				return nil, err
+		var item User
+		err := ac.db.Where("username = ?", user).First(&item).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			klog.Infof("create user %s", user)
+			if err := ac.CreateUser(user, passwd, -1); err != nil {
+				return err
 			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// a changed password of the config applies to the existing user
+		item.Password, item.Balance, item.Isblock = passwd, -1, 0
+		if err := ac.db.Save(&item).Error; err != nil {
+			return err
 		}
 	}
-	return as, nil
+	return nil
+}
+
+// DemoteStaticUsers blocks the users removed from the static users, an unlimited balance is taken back
+func (ac *AccountService) DemoteStaticUsers(usernames []string) error {
+	return ac.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("username IN ? AND balance < 0", usernames).Update("balance", 0).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("username IN ?", usernames).Update("is_block", 1).Error
+	})
+}
+
+// Close closes the database, after the chats are drained
+func (ac *AccountService) Close() error {
+	db, err := ac.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// WithContext returns the service running its queries with ctx, which traces them
+func (ac *AccountService) WithContext(ctx context.Context) *AccountService {
+	clone := *ac
+	clone.db = ac.db.WithContext(ctx)
+	return &clone
 }
 
 type AccountPayload struct {
@@ -83,59 +168,165 @@ type AccountPayload struct {
 	Count    int64  `json:"count"`
 	Username string `json:"i_username"`
 	Password string `json:"i_password"`
+	Uses     int64  `json:"uses"`   // registrations of an invite code, 1 when not set
+	Days     int    `json:"days"`   // days before an invite code expires, 0 never expires
+	Models   string `json:"models"` // model allowlist of an invite code, comma separated
+	Number   int    `json:"number"` // vouchers of a batch
+	Batch    string `json:"batch"`  // voucher batch name, generated when empty
+	Plan     string `json:"plan"`   // plan name
+	Period   string `json:"period"` // plan period: day, week or month
 }
 
 func (ac *AccountService) AccountProcess(ctx *gin.Context) {
+	ac = ac.WithContext(ctx)
 	payload := AccountPayload{}
 	if err := ctx.BindJSON(&payload); err != nil {
-		klog.Error(err)
-		ctx.JSON(200, gin.H{
-			"status":  "Fail",
-			"message": fmt.Sprintf("%v", err),
-			"data":    nil,
-		})
+		klog.FromContext(ctx).Error(err, "AccountProcess error")
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
 		return
 	}
 	if payload.Action == "recharge" {
 		if err := ac.IncBalance(payload.Username, payload.Count); err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"message": fmt.Sprintf("%v", err),
-			})
+			apierror.Fail(ctx, accountError(err))
 			return
 		}
 	}
 	if payload.Action == "check" {
 		if _, err := ac.CheckUser(payload.Username); err != nil {
-			ctx.JSON(http.StatusOK, gin.H{
-				"message": fmt.Sprintf("%v", err),
-			})
+			apierror.Fail(ctx, accountError(err))
 			return
 		}
 	}
 	if payload.Action == "register" {
 		if err := ac.CreateUser(payload.Username, payload.Password, payload.Count); err != nil {
-			ctx.JSON(http.StatusOK, gin.H{
-				"message": fmt.Sprintf("%v", err),
-			})
+			apierror.Fail(ctx, accountError(err))
 			return
 		}
 	}
 	if payload.Action == "grant" {
 		if err := ac.GrantUser(payload.Username, payload.Count); err != nil {
-			ctx.JSON(http.StatusOK, gin.H{
-				"message": fmt.Sprintf("%v", err),
-			})
+			apierror.Fail(ctx, accountError(err))
 			return
 		}
 	}
+	if payload.Action == "moderation" {
+		limit := int(payload.Count)
+		if limit <= 0 {
+			limit = ModerationListLimit
+		}
+		events, err := ac.ListModeration(payload.Username, limit)
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    events,
+		})
+		return
+	}
+	if payload.Action == "invite" {
+		invite, err := ac.CreateInvite(payload.Count, payload.Uses, payload.Days, payload.Models)
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    invite,
+		})
+		return
+	}
+	if payload.Action == "plan" {
+		plan, err := ac.SavePlan(payload.Plan, payload.Count, payload.Period)
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    plan,
+		})
+		return
+	}
+	if payload.Action == "plans" {
+		plans, err := ac.ListPlans()
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    plans,
+		})
+		return
+	}
+	if payload.Action == "assign" {
+		if err := ac.AssignPlan(payload.Username, payload.Plan); err != nil {
+			apierror.Fail(ctx, accountError(err))
+			return
+		}
+	}
+	if payload.Action == "topup" {
+		if _, err := ac.GrantTokens(payload.Username, payload.Count, payload.Days); err != nil {
+			apierror.Fail(ctx, accountError(err))
+			return
+		}
+	}
+	if payload.Action == "grants" {
+		grants, err := ac.ListGrants(payload.Username)
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    grants,
+		})
+		return
+	}
+	if payload.Action == "vouchers" {
+		batch, vouchers, err := ac.CreateVouchers(payload.Batch, payload.Number, payload.Count, payload.Days)
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		codes := make([]string, 0, len(vouchers))
+		for _, voucher := range vouchers {
+			codes = append(codes, voucher.Code)
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data": gin.H{
+				"batch": batch,
+				"codes": codes,
+			},
+		})
+		return
+	}
+	if payload.Action == "invites" {
+		invites, err := ac.ListInvites()
+		if err != nil {
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    invites,
+		})
+		return
+	}
 	if payload.Action == "list" {
 		users, err := ac.ListUser()
 		if err != nil {
-			ctx.JSON(http.StatusOK, gin.H{
-				"status":  "Fail",
-				"message": fmt.Sprintf("%v", err),
-				"data":    nil,
-			})
+			apierror.Fail(ctx, accountError(err))
 			return
 		}
 		ctx.JSON(http.StatusOK, gin.H{
@@ -150,6 +341,14 @@ func (ac *AccountService) AccountProcess(ctx *gin.Context) {
 	})
 }
 
+// accountError gives a missing user the not found code
+func accountError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apierror.Errorf(apierror.NotFound, "account.not.found")
+	}
+	return err
+}
+
 func (ac *AccountService) ListUser() ([]User, error) {
 	var users []User
 	result := ac.db.Find(&users)
@@ -160,7 +359,7 @@ func (ac *AccountService) CreateUser(name, password string, cnt int64) error {
 	var exist User
 	result := ac.db.Where(&User{Username: name}).First(&exist)
 	if result.Error == nil {
-		return errors.New("账户名存在")
+		return apierror.Errorf(apierror.Conflict, "account.exists")
 	}
 	var user User
 	user.Username = name
@@ -168,7 +367,7 @@ func (ac *AccountService) CreateUser(name, password string, cnt int64) error {
 	user.Balance = cnt
 	result = ac.db.Create(&user)
 	if result.Error != nil && strings.Contains(result.Error.Error(), "Duplicate") {
-		return errors.New("账户名存在")
+		return apierror.Errorf(apierror.Conflict, "account.exists")
 	}
 	return result.Error
 }
@@ -177,7 +376,7 @@ func (ac *AccountService) UpdateUser(oldName, oldPassword, name, password string
 	var exist User
 	result := ac.db.Where(&User{Username: name}).First(&exist)
 	if result.Error == nil && exist.Password != oldPassword {
-		return errors.New("账户名存在")
+		return apierror.Errorf(apierror.Conflict, "account.exists")
 	}
 	var user User
 	result = ac.db.Where(&User{Username: oldName, Password: oldPassword}).First(&user)
@@ -188,7 +387,7 @@ func (ac *AccountService) UpdateUser(oldName, oldPassword, name, password string
 	user.Password = password
 	result = ac.db.Save(&user)
 	if result.Error != nil && strings.Contains(result.Error.Error(), "Duplicate") {
-		return errors.New("账户名存在")
+		return apierror.Errorf(apierror.Conflict, "account.exists")
 	}
 	return result.Error
 }
@@ -226,49 +425,144 @@ func (ac *AccountService) GrantUser(username string, block int64) error {
 	return result.Error
 }
 
+// IncBalance adds cnt to the balance in one update, so concurrent recharges are not lost
 func (ac *AccountService) IncBalance(username string, cnt int64) error {
+	result := ac.db.Model(&User{}).Where("username = ?", username).UpdateColumn("balance", gorm.Expr("balance + ?", cnt))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// IncUsage charges cnt to the allowance of the plan in the current period, then to the grants
+// expiring first, and the rest to the lifetime balance. The user and the grants are locked, and the
+// updates are conditional for the databases without row locks, so concurrent completions never
+// charge an allowance or a grant twice.
+func (ac *AccountService) IncUsage(username string, cnt int64) error {
+	return ac.db.Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("username = ?", username).First(&user).Error; err != nil {
+			return err
+		}
+		left := cnt
+		now := time.Now()
+		if user.Balance >= 0 && user.PlanID != 0 {
+			var plan Plan
+			err := tx.First(&plan, user.PlanID).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err == nil {
+				start, used := periodStart(plan.Period, now), periodUsage(plan, user, now)
+				take := plan.Allowance - used
+				if take > left {
+					take = left
+				}
+				if take > 0 {
+					// a new period starts from 0, the current one only grows within the allowance
+					var update *gorm.DB
+					if user.PeriodStart != nil && !user.PeriodStart.Before(start) {
+						update = tx.Model(&User{}).Where("id = ? AND period_start >= ? AND period_usage + ? <= ?", user.ID, start, take, plan.Allowance).
+							UpdateColumn("period_usage", gorm.Expr("period_usage + ?", take))
+					} else {
+						update = tx.Model(&User{}).Where("id = ? AND (period_start IS NULL OR period_start < ?)", user.ID, start).
+							Updates(map[string]interface{}{"period_usage": take, "period_start": start})
+					}
+					if update.Error != nil {
+						return update.Error
+					}
+					if update.RowsAffected > 0 {
+						left -= take
+					}
+				}
+			}
+		}
+		if user.Balance >= 0 && left > 0 {
+			grants, err := activeGrants(tx.Clauses(clause.Locking{Strength: "UPDATE"}), username, now)
+			if err != nil {
+				return err
+			}
+			for _, grant := range grants {
+				if left == 0 {
+					break
+				}
+				take := grant.Amount - grant.Used
+				if take > left {
+					take = left
+				}
+				update := tx.Model(&Grant{}).Where("id = ? AND used + ? <= amount", grant.ID, take).UpdateColumn("used", gorm.Expr("used + ?", take))
+				if update.Error != nil {
+					return update.Error
+				}
+				if update.RowsAffected > 0 {
+					left -= take
+				}
+			}
+		}
+		if left == 0 {
+			return nil
+		}
+		return tx.Model(&User{}).Where("id = ?", user.ID).UpdateColumn("usage", gorm.Expr("? + ?", clause.Column{Name: "usage"}, left)).Error
+	})
+}
+
+func (ac *AccountService) UpdateModel(username, model string) error {
 	var user User
 	result := ac.db.Where(&User{Username: username}).First(&user)
 	if result.Error != nil {
 		return result.Error
 	}
-	user.Balance = user.Balance + int64(cnt)
+	user.Model = model
 	result = ac.db.Save(&user)
 	return result.Error
 }
 
-func (ac *AccountService) IncUsage(username string, cnt int64) error {
+func (ac *AccountService) UpdateSystem(username, system string) error {
 	var user User
 	result := ac.db.Where(&User{Username: username}).First(&user)
 	if result.Error != nil {
 		return result.Error
 	}
-	user.Usage = user.Usage + int64(cnt)
+	user.System = system
 	result = ac.db.Save(&user)
 	return result.Error
 }
 
-func (ac *AccountService) UpdateModel(username, model string) error {
+func (ac *AccountService) UpdateLocale(username, locale string) error {
 	var user User
 	result := ac.db.Where(&User{Username: username}).First(&user)
 	if result.Error != nil {
 		return result.Error
 	}
-	user.Model = model
+	user.Locale = locale
 	result = ac.db.Save(&user)
 	return result.Error
 }
 
-func (ac *AccountService) AuthenticateUser(username, password string) int {
+func (ac *AccountService) AuthenticateUser(username, password string) (User, int) {
 	var user User
 	result := ac.db.Where(&User{Username: username, Password: password}).First(&user)
 	if result.Error != nil {
-		return 1
+		return user, 1
 	}
+	return user, ac.authenticateCode(user)
+}
+
+// authenticateCode is 1 for a blocked user and 2 when nothing is left in the current period of the plan,
+// the grants and the balance
+func (ac *AccountService) authenticateCode(user User) int {
 	if user.Isblock > 0 {
 		return 1
 	}
-	if user.Balance >= 0 && user.Usage >= user.Balance {
+	allowance, err := ac.AllowanceOf(user)
+	if err != nil {
+		klog.ErrorS(err, "check allowance error", "username", user.Username)
+		return 1
+	}
+	if !allowance.Unlimited && allowance.Remaining() <= 0 {
 		return 2
 	}
 	return 0
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestAccounts(t *testing.T) *AccountService {
+	t.Helper()
+	ac, err := NewAccountService(filepath.Join(t.TempDir(), "test.db"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ac.Close() })
+	return ac
+}
+
+func TestSyncStaticUsersPassword(t *testing.T) {
+	ac := newTestAccounts(t)
+	if err := ac.SyncStaticUsers("alice,bob", "first1,second2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.DemoteStaticUsers([]string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+	// a reload changes the password of alice and lists bob again
+	if err := ac.SyncStaticUsers("alice,bob", "changed1,second2"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "changed1", true},
+		{"alice", "first1", false},
+		{"bob", "second2", true},
+	}
+	for _, tt := range tests {
+		user, err := ac.GetUser(tt.username, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("GetUser(%s, %s) error = %v, want ok %v", tt.username, tt.password, err, tt.ok)
+			continue
+		}
+		if tt.ok && (user.Balance != -1 || user.Isblock != 0) {
+			t.Errorf("%s: balance %d blocked %d, want an unlimited active user", tt.username, user.Balance, user.Isblock)
+		}
+	}
+}
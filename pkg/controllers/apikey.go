@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+)
+
+const (
+	APIKeyPrefix  = "cw-"
+	APIKeyMaxKeys = 10
+)
+
+// APIKey is a personal key for the Authorization: Bearer header, only the sha256 of the key is stored
+type APIKey struct {
+	ID        int64     `gorm:"column:id;primaryKey;autoIncrement"`
+	Username  string    `gorm:"column:username;not null;index"`
+	Hash      string    `gorm:"column:hash;type:varchar(64);not null;unique"`
+	Prefix    string    `gorm:"column:prefix;type:varchar(16);not null;index"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey returns a new key of the user, the plain key can not be read again
+func (ac *AccountService) CreateAPIKey(username string) (string, error) {
+	var count int64
+	if err := ac.db.Model(&APIKey{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count >= APIKeyMaxKeys {
+		return "", apierror.Errorf(apierror.Conflict, "apikey.too.many", APIKeyMaxKeys)
+	}
+	bts := make([]byte, 24)
+	if _, err := rand.Read(bts); err != nil {
+		return "", err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(bts)
+	item := APIKey{
+		Username: username,
+		Hash:     hashAPIKey(key),
+		Prefix:   key[:len(APIKeyPrefix)+8],
+	}
+	if err := ac.db.Create(&item).Error; err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (ac *AccountService) ListAPIKeys(username string) ([]APIKey, error) {
+	var keys []APIKey
+	result := ac.db.Where("username = ?", username).Order("id").Find(&keys)
+	return keys, result.Error
+}
+
+func (ac *AccountService) RevokeAPIKey(username, prefix string) error {
+	result := ac.db.Where("username = ? AND prefix = ?", username, prefix).Delete(&APIKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return apierror.Errorf(apierror.NotFound, "apikey.not.found")
+	}
+	return nil
+}
+
+// AuthenticateAPIKey works like AuthenticateUser for a bearer key and also returns the owner
+func (ac *AccountService) AuthenticateAPIKey(key string) (User, int) {
+	var item APIKey
+	if err := ac.db.Where("hash = ?", hashAPIKey(key)).First(&item).Error; err != nil {
+		return User{}, 1
+	}
+	user, err := ac.CheckUser(item.Username)
+	if err != nil {
+		return user, 1
+	}
+	return user, ac.authenticateCode(user)
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	openai "github.com/sashabaranov/go-openai"
+	"k8s.io/klog/v2"
+)
+
+// ChatBranch holds the children of one message, Active is the branch shown in the thread
+type ChatBranch struct {
+	Children []string `json:"children"`
+	Active   string   `json:"active"`
+}
+
+type ChatRegenerateRequest struct {
+	ID          string   `json:"id"`
+	Temperature *float32 `json:"temperature"`
+}
+
+type ChatEditRequest struct {
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+}
+
+type ChatSibling struct {
+	ID     string `json:"id"`
+	Role   string `json:"role"`
+	Text   string `json:"text"`
+	Active bool   `json:"active"`
+}
+
+// siblingKey groups messages with the same parent, edited roots share the key of the first root
+func siblingKey(message ChatMessage) string {
+	if message.ParentMessageId != "" {
+		return message.ParentMessageId
+	}
+	if message.Branch != "" {
+		return message.Branch
+	}
+	return "root:" + message.ID
+}
+
+// addBranch registers message under its parent and makes it the active branch
+func (chat *ChatService) addBranch(message ChatMessage) {
+	chat.branchLock.Lock()
+	defer chat.branchLock.Unlock()
+	key := siblingKey(message)
+	branch := ChatBranch{}
+	if item := chat.branches.Get(key); item != nil && !item.Expired() {
+		branch = item.Value()
+	}
+	exist := false
+	for _, id := range branch.Children {
+		if id == message.ID {
+			exist = true
+			break
+		}
+	}
+	if !exist {
+		branch.Children = append(branch.Children, message.ID)
+	}
+	branch.Active = message.ID
+	chat.branches.Set(key, branch, chat.params().ChatSessionTTL)
+}
+
+func (chat *ChatService) getBranch(key string) (ChatBranch, bool) {
+	chat.branchLock.Lock()
+	defer chat.branchLock.Unlock()
+	item := chat.branches.Get(key)
+	if item == nil || item.Expired() {
+		return ChatBranch{}, false
+	}
+	return item.Value(), true
+}
+
+func (chat *ChatService) setActiveBranch(message ChatMessage) {
+	chat.branchLock.Lock()
+	defer chat.branchLock.Unlock()
+	key := siblingKey(message)
+	if item := chat.branches.Get(key); item != nil && !item.Expired() {
+		branch := item.Value()
+		branch.Active = message.ID
+		chat.branches.Set(key, branch, chat.params().ChatSessionTTL)
+	}
+}
+
+// activeLeaf follows the active branches of username down from id and returns the last message id
+func (chat *ChatService) activeLeaf(id, username string) string {
+	for {
+		branch, ok := chat.getBranch(id)
+		if !ok || branch.Active == "" {
+			return id
+		}
+		if message, ok := chat.getMessageByID(branch.Active); !ok || message.Username != username {
+			return id
+		}
+		id = branch.Active
+	}
+}
+
+func (chat *ChatService) getUserMessage(ctx *gin.Context, id string) (ChatMessage, bool) {
+	message, ok := chat.getMessageByID(id)
+	if !ok || message.Username != ctx.GetString("username") {
+		apierror.Fail(ctx, apierror.Errorf(apierror.NotFound, "chat.message.not.found"))
+		return message, false
+	}
+	return message, true
+}
+
+// ChatRegenerate re-sends the parent of an assistant reply and streams a sibling reply
+func (chat *ChatService) ChatRegenerate(ctx *gin.Context) {
+	payload := ChatRegenerateRequest{}
+	if err := ctx.BindJSON(&payload); err != nil {
+		klog.FromContext(ctx).Error(err, "ChatRegenerate error")
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	reply, ok := chat.getUserMessage(ctx, payload.ID)
+	if !ok {
+		return
+	}
+	if reply.Role != openai.ChatMessageRoleAssistant {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "chat.regenerate.role"))
+		return
+	}
+	message, ok := chat.getUserMessage(ctx, reply.ParentMessageId)
+	if !ok {
+		return
+	}
+	temperature := float32(-1000.0)
+	if payload.Temperature != nil {
+		temperature = *payload.Temperature
+	}
+	chat.process(ctx, ChatMessageRequest{
+		Prompt: message.Text,
+		Images: message.Images,
+		Options: ChatMessageRequestOptions{
+			Name:            message.Name,
+			ParentMessageId: message.ParentMessageId,
+			Collection:      message.Collection,
+		},
+	}, message, true, temperature)
+}
+
+// ChatEdit sends a new version of a past user message as its sibling
+func (chat *ChatService) ChatEdit(ctx *gin.Context) {
+	payload := ChatEditRequest{}
+	if err := ctx.BindJSON(&payload); err != nil {
+		klog.FromContext(ctx).Error(err, "ChatEdit error")
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	origin, ok := chat.getUserMessage(ctx, payload.ID)
+	if !ok {
+		return
+	}
+	if origin.Role != openai.ChatMessageRoleUser || payload.Prompt == "" {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "chat.edit.role"))
+		return
+	}
+	message := ChatMessage{
+		ID:              uuid.New().String(),
+		Role:            openai.ChatMessageRoleUser,
+		Text:            payload.Prompt,
+		Name:            origin.Name,
+		ParentMessageId: origin.ParentMessageId,
+		Images:          origin.Images,
+		Collection:      origin.Collection,
+		Username:        origin.Username,
+		Branch:          siblingKey(origin),
+	}
+	chat.process(ctx, ChatMessageRequest{
+		Prompt: message.Text,
+		Images: message.Images,
+		Options: ChatMessageRequestOptions{
+			Name:            message.Name,
+			ParentMessageId: message.ParentMessageId,
+			Collection:      message.Collection,
+		},
+	}, message, false, -1000.0)
+}
+
+func (chat *ChatService) ChatSiblings(ctx *gin.Context) {
+	message, ok := chat.getUserMessage(ctx, ctx.Param("id"))
+	if !ok {
+		return
+	}
+	branch, ok := chat.getBranch(siblingKey(message))
+	if !ok {
+		branch = ChatBranch{Children: []string{message.ID}, Active: message.ID}
+	}
+	siblings := []ChatSibling{}
+	for _, id := range branch.Children {
+		item, ok := chat.getMessageByID(id)
+		if !ok || item.Username != message.Username {
+			continue
+		}
+		siblings = append(siblings, ChatSibling{
+			ID:     item.ID,
+			Role:   item.Role,
+			Text:   item.Text,
+			Active: item.ID == branch.Active,
+		})
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data": gin.H{
+			"siblings": siblings,
+			"active":   branch.Active,
+		},
+	})
+}
+
+// ChatActivate switches the active branch to the message and returns the leaf of that branch
+func (chat *ChatService) ChatActivate(ctx *gin.Context) {
+	message, ok := chat.getUserMessage(ctx, ctx.Param("id"))
+	if !ok {
+		return
+	}
+	chat.setActiveBranch(message)
+	leaf := chat.activeLeaf(message.ID, message.Username)
+	thread := chat.getThread(leaf, message.Username)
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data": gin.H{
+			"leaf":   leaf,
+			"thread": thread,
+		},
+	})
+}
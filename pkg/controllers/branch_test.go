@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	ccache "github.com/karlseguin/ccache/v3"
+)
+
+func newTestChat() *ChatService {
+	chat := &ChatService{
+		store:    ccache.New(ccache.Configure[ChatMessage]()),
+		branches: ccache.New(ccache.Configure[ChatBranch]()),
+	}
+	chat.settings.Store(&ChatCompletionParams{ChatSessionTTL: time.Hour})
+	return chat
+}
+
+func (chat *ChatService) addTestMessage(message ChatMessage) {
+	chat.store.Set(message.ID, message, time.Hour)
+	chat.addBranch(message)
+}
+
+func TestThreadStopsAtOtherUsers(t *testing.T) {
+	chat := newTestChat()
+	chat.addTestMessage(ChatMessage{ID: "a1", Role: "user", Username: "alice"})
+	chat.addTestMessage(ChatMessage{ID: "a2", Role: "assistant", ParentMessageId: "a1", Username: "alice"})
+	// bob replies under the conversation of alice
+	chat.addTestMessage(ChatMessage{ID: "b1", Role: "user", ParentMessageId: "a2", Username: "bob"})
+	chat.addTestMessage(ChatMessage{ID: "b2", Role: "assistant", ParentMessageId: "b1", Username: "bob"})
+
+	tests := []struct {
+		leaf, username string
+		want           []string
+	}{
+		{"b2", "bob", []string{"b1", "b2"}},
+		{"a2", "alice", []string{"a1", "a2"}},
+		{"a2", "bob", []string{}},
+		{"missing", "bob", []string{}},
+	}
+	for _, tt := range tests {
+		thread := chat.getThread(tt.leaf, tt.username)
+		got := []string{}
+		for _, message := range thread {
+			got = append(got, message.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("getThread(%s, %s) = %v, want %v", tt.leaf, tt.username, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("getThread(%s, %s) = %v, want %v", tt.leaf, tt.username, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// the active branch under a2 is the reply of bob, alice stays on her own leaf
+	if leaf := chat.activeLeaf("a1", "alice"); leaf != "a2" {
+		t.Errorf("activeLeaf(a1, alice) = %s, want a2", leaf)
+	}
+}
@@ -0,0 +1,333 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/redaction"
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
+	"github.com/gin-gonic/gin"
+	ccache "github.com/karlseguin/ccache/v3"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	CacheReplayChunkRunes = 16
+	CacheReplayInterval   = 20 * time.Millisecond // between the chunks of a replayed reply, about a live stream
+	CacheSemanticEntries  = 32                    // similar prompts kept per conversation context
+)
+
+// cachedReply is a completion without tool calls, its text keeps the redaction placeholders
+type cachedReply struct {
+	Text             string
+	PromptTokens     int64
+	CompletionTokens int64
+	Estimated        bool
+}
+
+type semanticReply struct {
+	vector  []float32
+	reply   cachedReply
+	expires time.Time
+}
+
+// replyCache keeps replies by the exact request, and with a similarity by the conversation
+// context before the prompt and the embedding of the prompt
+type replyCache struct {
+	ttl          time.Duration
+	similarity   float64
+	exact        *ccache.Cache[cachedReply]
+	semantic     *ccache.Cache[[]semanticReply]
+	semanticLock sync.Mutex
+	hits         atomic.Int64
+	semanticHits atomic.Int64
+	misses       atomic.Int64
+	stores       atomic.Int64
+}
+
+func newReplyCache(ttl time.Duration, similarity float64) *replyCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &replyCache{
+		ttl:        ttl,
+		similarity: similarity,
+		exact:      ccache.New(ccache.Configure[cachedReply]()),
+		semantic:   ccache.New(ccache.Configure[[]semanticReply]()),
+	}
+}
+
+type CacheStats struct {
+	Enabled      bool    `json:"enabled"`
+	Entries      int     `json:"entries"`
+	Hits         int64   `json:"hits"`
+	SemanticHits int64   `json:"semantic_hits"`
+	Misses       int64   `json:"misses"`
+	Stores       int64   `json:"stores"`
+	HitRatio     float64 `json:"hit_ratio"`
+}
+
+// CacheStats reports the hits and misses of the reply cache to ops
+func (chat *ChatService) CacheStats(ctx *gin.Context) {
+	stats := CacheStats{}
+	if c := chat.cache; c != nil {
+		stats = CacheStats{
+			Enabled:      true,
+			Entries:      c.exact.ItemCount(),
+			Hits:         c.hits.Load(),
+			SemanticHits: c.semanticHits.Load(),
+			Misses:       c.misses.Load(),
+			Stores:       c.stores.Load(),
+		}
+		if total := stats.Hits + stats.SemanticHits + stats.Misses; total > 0 {
+			stats.HitRatio = float64(stats.Hits+stats.SemanticHits) / float64(total)
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data":    stats,
+	})
+}
+
+type cacheMessage struct {
+	Role    string   `json:"role"`
+	Name    string   `json:"name,omitempty"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+type cacheKey struct {
+	Model            string         `json:"model"`
+	Temperature      float32        `json:"temperature"`
+	PresencePenalty  float32        `json:"presence_penalty"`
+	FrequencyPenalty float32        `json:"frequency_penalty"`
+	MaxTokens        int            `json:"max_tokens"`
+	Tools            []string       `json:"tools,omitempty"`
+	Messages         []cacheMessage `json:"messages"`
+}
+
+// cacheKeys returns the key of the whole request, the key of the request without the last
+// message and the text of the last message, white space in the messages is normalized
+func cacheKeys(request openai.ChatCompletionRequest) (string, string, string) {
+	key := cacheKey{
+		Model:            request.Model,
+		Temperature:      request.Temperature,
+		PresencePenalty:  request.PresencePenalty,
+		FrequencyPenalty: request.FrequencyPenalty,
+		MaxTokens:        request.MaxTokens,
+	}
+	for _, tool := range request.Tools {
+		if tool.Function != nil {
+			key.Tools = append(key.Tools, tool.Function.Name)
+		}
+	}
+	for _, message := range request.Messages {
+		item := cacheMessage{
+			Role:    message.Role,
+			Name:    message.Name,
+			Content: normalize(message.Content),
+		}
+		for _, part := range message.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeText {
+				item.Content = normalize(part.Text)
+			} else if part.ImageURL != nil {
+				item.Images = append(item.Images, part.ImageURL.URL)
+			}
+		}
+		key.Messages = append(key.Messages, item)
+	}
+	exact := hashKey(key)
+	prompt := ""
+	if n := len(key.Messages); n > 0 {
+		prompt = key.Messages[n-1].Content
+		key.Messages = key.Messages[:n-1]
+	}
+	return exact, hashKey(key), prompt
+}
+
+func normalize(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+func hashKey(key cacheKey) string {
+	bts, _ := json.Marshal(key)
+	sum := sha256.Sum256(bts)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupReply finds a cached reply of the request, with a similarity threshold the prompt
+// is embedded and its vector kept on st for storing the reply of a miss
+func (chat *ChatService) lookupReply(st *chatStream, request openai.ChatCompletionRequest) (cachedReply, bool) {
+	c := chat.cache
+	if c == nil {
+		return cachedReply{}, false
+	}
+	exact, prefix, prompt := cacheKeys(request)
+	if item := c.exact.Get(exact); item != nil && !item.Expired() {
+		c.hits.Add(1)
+		trace.SpanFromContext(st.ctx).SetAttributes(attribute.String("cache", "exact"))
+		return item.Value(), true
+	}
+	if c.similarity > 0 && prompt != "" {
+		vectors, err := chat.embed(st.ctx, st.username, []string{prompt})
+		if err != nil {
+			klog.FromContext(st.ctx).Error(err, "embed cache prompt error")
+		} else {
+			st.cacheVector = vectors[0]
+			if reply, ok := c.similar(prefix, st.cacheVector); ok {
+				c.semanticHits.Add(1)
+				trace.SpanFromContext(st.ctx).SetAttributes(attribute.String("cache", "semantic"))
+				return reply, true
+			}
+		}
+	}
+	c.misses.Add(1)
+	return cachedReply{}, false
+}
+
+func (c *replyCache) similar(prefix string, vector []float32) (cachedReply, bool) {
+	item := c.semantic.Get(prefix)
+	if item == nil {
+		return cachedReply{}, false
+	}
+	best, found := cachedReply{}, false
+	score := c.similarity
+	now := time.Now()
+	for _, entry := range item.Value() {
+		if entry.expires.Before(now) {
+			continue
+		}
+		if s := cosine(vector, entry.vector); s >= score {
+			best, score, found = entry.reply, s, true
+		}
+	}
+	return best, found
+}
+
+func (chat *ChatService) storeReply(st *chatStream, request openai.ChatCompletionRequest, reply cachedReply) {
+	c := chat.cache
+	if c == nil {
+		return
+	}
+	exact, prefix, _ := cacheKeys(request)
+	c.exact.Set(exact, reply, c.ttl)
+	c.stores.Add(1)
+	if st.cacheVector == nil {
+		return
+	}
+	c.semanticLock.Lock()
+	defer c.semanticLock.Unlock()
+	entries := []semanticReply{}
+	if item := c.semantic.Get(prefix); item != nil {
+		for _, entry := range item.Value() {
+			if entry.expires.After(time.Now()) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	entries = append(entries, semanticReply{vector: st.cacheVector, reply: reply, expires: time.Now().Add(c.ttl)})
+	if len(entries) > CacheSemanticEntries {
+		entries = entries[len(entries)-CacheSemanticEntries:]
+	}
+	c.semantic.Set(prefix, entries, c.ttl)
+}
+
+// replay streams a cached reply into st as if it came from the upstream, then stores it and
+// bills it with the cache discount, a canceled replay is billed for the part sent
+func (chat *ChatService) replay(st *chatStream, request openai.ChatCompletionRequest, reply cachedReply) {
+	defer chat.inflight.Done()
+	defer st.cancel()
+	result := st.result
+	var restorer *redaction.Restorer
+	if chat.params().RedactRestore {
+		restorer = redaction.NewRestorer(st.mapping)
+	}
+	runes := []rune(reply.Text)
+	ticker := time.NewTicker(CacheReplayInterval)
+	defer ticker.Stop()
+	sent, canceled := 0, false
+	for sent < len(runes) && !canceled {
+		end := sent + CacheReplayChunkRunes
+		if end > len(runes) {
+			end = len(runes)
+		}
+		delta := restorer.Write(string(runes[sent:end]))
+		result.Text += delta
+		st.append(chatFrame{ID: result.ID, Delta: delta})
+		sent = end
+		if sent < len(runes) {
+			select {
+			case <-st.ctx.Done():
+				canceled = true
+			case <-ticker.C:
+			}
+		}
+	}
+	if rest := restorer.Flush(); rest != "" {
+		result.Text += rest
+		st.append(chatFrame{ID: result.ID, Delta: rest})
+	}
+	st.finish(nil)
+	time.AfterFunc(ChatStreamRetention, func() {
+		chat.streams.remove(result.ID)
+	})
+
+	completionTokens := reply.CompletionTokens
+	if canceled {
+		klog.FromContext(st.ctx).Info("chat canceled", "id", result.ID, "chars", len(result.Text))
+		completionTokens = completionTokens * int64(sent) / int64(len(runes))
+	}
+	result.TokenCount = int(completionTokens)
+	chat.store.Set(result.ID, result, chat.params().ChatSessionTTL)
+	chat.addBranch(result)
+
+	charged := int64(100 - chat.params().CacheDiscount)
+	record := UsageRecord{
+		Username:         st.username,
+		MessageID:        result.ID,
+		Model:            request.Model,
+		PromptTokens:     reply.PromptTokens * charged / 100,
+		CompletionTokens: completionTokens * charged / 100,
+		Source:           UsageSourceCache,
+		Redactions:       int64(st.mapping.Count),
+		Estimated:        reply.Estimated,
+	}
+	outcome := "ok"
+	if canceled {
+		outcome = "canceled"
+	}
+	logger := klog.FromContext(st.ctx)
+	if err := chat.recordUsage(tracing.Detach(st.ctx, context.Background()), record); err != nil {
+		logger.Error(err, "record usage error", "id", result.ID)
+	}
+	logger.Info("chat completion",
+		"id", result.ID,
+		"username", st.username,
+		"model", request.Model,
+		"prompt_tokens", record.PromptTokens,
+		"completion_tokens", record.CompletionTokens,
+		"usage_source", record.Source,
+		"latency_ms", time.Since(st.started).Milliseconds(),
+		"outcome", outcome,
+	)
+	span := trace.SpanFromContext(st.ctx)
+	span.SetAttributes(
+		attribute.String("id", result.ID),
+		attribute.Int64("prompt_tokens", record.PromptTokens),
+		attribute.Int64("completion_tokens", record.CompletionTokens),
+		attribute.String("usage_source", record.Source),
+		attribute.String("outcome", outcome),
+	)
+	tracing.End(span, nil)
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCacheKeys(t *testing.T) {
+	request := func(model string, tools []string, contents ...string) openai.ChatCompletionRequest {
+		r := openai.ChatCompletionRequest{Model: model}
+		for _, name := range tools {
+			r.Tools = append(r.Tools, openai.Tool{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: name}})
+		}
+		for _, content := range contents {
+			r.Messages = append(r.Messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: content})
+		}
+		return r
+	}
+	base := request("gpt-4o", nil, "hi", "what is go")
+	baseExact, baseContext, _ := cacheKeys(base)
+	tests := []struct {
+		name        string
+		request     openai.ChatCompletionRequest
+		sameExact   bool
+		sameContext bool
+		prompt      string
+	}{
+		{"same request", base, true, true, "what is go"},
+		{"white space", request("gpt-4o", nil, " hi\n", "what  is\tgo "), true, true, "what is go"},
+		{"other prompt", request("gpt-4o", nil, "hi", "what is rust"), false, true, "what is rust"},
+		{"other history", request("gpt-4o", nil, "hello", "what is go"), false, false, "what is go"},
+		{"other model", request("gpt-4o-mini", nil, "hi", "what is go"), false, false, "what is go"},
+		{"with tools", request("gpt-4o", []string{"search"}, "hi", "what is go"), false, false, "what is go"},
+		{"no messages", request("gpt-4o", nil), false, false, ""},
+	}
+	for _, tt := range tests {
+		exact, context, prompt := cacheKeys(tt.request)
+		if (exact == baseExact) != tt.sameExact {
+			t.Errorf("%s: same exact key = %v, want %v", tt.name, exact == baseExact, tt.sameExact)
+		}
+		if (context == baseContext) != tt.sameContext {
+			t.Errorf("%s: same context key = %v, want %v", tt.name, context == baseContext, tt.sameContext)
+		}
+		if prompt != tt.prompt {
+			t.Errorf("%s: prompt = %q, want %q", tt.name, prompt, tt.prompt)
+		}
+	}
+}
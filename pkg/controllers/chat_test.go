@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Arvintian/chatgpt-web/pkg/tokenizer"
+	"github.com/sashabaranov/go-openai"
+)
+
+// fakeTokenizer counts a token per rune of the content, or fails when down
+type fakeTokenizer struct {
+	down bool
+}
+
+func (f fakeTokenizer) Count(ctx context.Context, message openai.ChatCompletionMessage, model string) (int, bool, error) {
+	if f.down {
+		return 0, false, errors.New("tokenizer down")
+	}
+	return len([]rune(message.Content)), false, nil
+}
+
+func (f fakeTokenizer) CountBatch(ctx context.Context, messages []openai.ChatCompletionMessage, model string) ([]int, bool, error) {
+	counts := []int{}
+	for _, message := range messages {
+		count, _, err := f.Count(ctx, message, model)
+		if err != nil {
+			return nil, false, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, false, nil
+}
+
+func useTokenizer(t *testing.T, fake tokenizer.Tokenizer) {
+	saved := tokenizer.Default
+	tokenizer.Default = fake
+	t.Cleanup(func() { tokenizer.Default = saved })
+}
+
+func TestCountToolCalls(t *testing.T) {
+	chat := &ChatService{}
+	message := openai.ChatCompletionMessage{
+		Role:      openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{{Function: openai.FunctionCall{Name: "search", Arguments: `{"q":"go"}`}}},
+	}
+	text := "\nsearch " + `{"q":"go"}`
+	tests := []struct {
+		name      string
+		down      bool
+		want      int
+		estimated bool
+	}{
+		{"counted", false, len(text), false},
+		{"estimated", true, tokenizer.Estimate(openai.ChatCompletionMessage{Role: message.Role, Content: text}), true},
+	}
+	for _, tt := range tests {
+		useTokenizer(t, fakeTokenizer{down: tt.down})
+		got, estimated := chat.countToolCalls(context.Background(), message, "gpt-4o")
+		if got != tt.want || estimated != tt.estimated {
+			t.Errorf("%s: countToolCalls() = %d, %v, want %d, %v", tt.name, got, estimated, tt.want, tt.estimated)
+		}
+	}
+}
+
+func TestTruncateToolOutput(t *testing.T) {
+	chat := &ChatService{}
+	output := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, Content: strings.Repeat("a", 1000)}
+	tests := []struct {
+		name      string
+		down      bool
+		maxTokens int
+		estimated bool
+		truncated bool
+	}{
+		{"fits", false, 2000, false, false},
+		{"counted", false, 100, false, true},
+		{"estimated", true, 100, true, true},
+		{"nothing fits", true, 1, true, true},
+	}
+	for _, tt := range tests {
+		useTokenizer(t, fakeTokenizer{down: tt.down})
+		got, tokens, estimated := chat.truncateToolOutput(context.Background(), output, "gpt-4o", tt.maxTokens)
+		if estimated != tt.estimated {
+			t.Errorf("%s: estimated = %v, want %v", tt.name, estimated, tt.estimated)
+		}
+		if truncated := strings.HasSuffix(got.Content, "[truncated]"); truncated != tt.truncated {
+			t.Errorf("%s: truncated = %v, want %v", tt.name, truncated, tt.truncated)
+		}
+		if tt.maxTokens > 1 && tokens > tt.maxTokens {
+			t.Errorf("%s: %d tokens, want at most %d", tt.name, tokens, tt.maxTokens)
+		}
+	}
+}
+
+func TestMergeToolCalls(t *testing.T) {
+	index := func(i int) *int { return &i }
+	tests := []struct {
+		name   string
+		deltas [][]openai.ToolCall
+		want   []openai.ToolCall
+	}{
+		{"no deltas", nil, nil},
+		{
+			"arguments in pieces",
+			[][]openai.ToolCall{
+				{{Index: index(0), ID: "call_1", Function: openai.FunctionCall{Name: "search"}}},
+				{{Index: index(0), Function: openai.FunctionCall{Arguments: `{"q":`}}},
+				{{Index: index(0), Function: openai.FunctionCall{Arguments: `"go"}`}}},
+			},
+			[]openai.ToolCall{{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "search", Arguments: `{"q":"go"}`}}},
+		},
+		{
+			"parallel calls",
+			[][]openai.ToolCall{
+				{{Index: index(0), ID: "call_1", Function: openai.FunctionCall{Name: "search"}}},
+				{{Index: index(1), ID: "call_2", Function: openai.FunctionCall{Name: "fetch"}}},
+				{{Index: index(1), Function: openai.FunctionCall{Arguments: "{}"}}, {Index: index(0), Function: openai.FunctionCall{Arguments: "{}"}}},
+			},
+			[]openai.ToolCall{
+				{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "search", Arguments: "{}"}},
+				{ID: "call_2", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "fetch", Arguments: "{}"}},
+			},
+		},
+		{
+			"without index",
+			[][]openai.ToolCall{
+				{{ID: "call_1", Function: openai.FunctionCall{Name: "search", Arguments: "{}"}}},
+				{{ID: "call_2", Function: openai.FunctionCall{Name: "fetch", Arguments: "{}"}}},
+			},
+			[]openai.ToolCall{
+				{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "search", Arguments: "{}"}},
+				{ID: "call_2", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "fetch", Arguments: "{}"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		var calls []openai.ToolCall
+		for _, deltas := range tt.deltas {
+			calls = mergeToolCalls(calls, deltas)
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%s: mergeToolCalls() = %+v, want %+v", tt.name, calls, tt.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/redaction"
+	"github.com/Arvintian/chatgpt-web/pkg/tokenizer"
+	"github.com/gin-gonic/gin"
+	"github.com/ledongthuc/pdf"
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DocumentMaxBytes   = 20 << 20
+	DocumentChunkRunes = 1200
+	DocumentEmbedBatch = 64
+
+	DocumentCachedCollections = 100 // collections with their embeddings decoded in memory
+	DocumentVectorsTTL        = 10 * time.Minute
+)
+
+type Document struct {
+	ID         int64     `gorm:"column:id;primaryKey;autoIncrement"`
+	Username   string    `gorm:"column:username;not null;index"`
+	Collection string    `gorm:"column:collection;not null;default:'';index"`
+	Name       string    `gorm:"column:name;not null;default:''"`
+	Size       int64     `gorm:"column:size;not null;default:0"`
+	Chunks     int       `gorm:"column:chunks;not null;default:0"`
+	Tokens     int64     `gorm:"column:tokens;not null;default:0"`
+	CreatedAt  time.Time `gorm:"column:created_at"`
+}
+
+func (Document) TableName() string {
+	return "documents"
+}
+
+type DocumentChunk struct {
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement"`
+	DocumentID int64  `gorm:"column:document_id;not null;index"`
+	Username   string `gorm:"column:username;not null;index"`
+	Collection string `gorm:"column:collection;not null;default:'';index"`
+	Seq        int    `gorm:"column:seq;not null;default:0"`
+	Content    string `gorm:"column:content;type:text;not null"`
+	Tokens     int    `gorm:"column:tokens;not null;default:0"`
+	Embedding  []byte `gorm:"column:embedding"` // little endian float32 vector
+}
+
+func (DocumentChunk) TableName() string {
+	return "document_chunks"
+}
+
+// chunkVector is a chunk without its content, for ranking it against a prompt
+type chunkVector struct {
+	ID     int64
+	Tokens int
+	Vector []float32
+}
+
+func vectorsKey(username, collection string) string {
+	return username + "\x00" + collection
+}
+
+func (chat *ChatService) DocumentUpload(ctx *gin.Context) {
+	username := ctx.GetString("username")
+	// chats retrieve from a named collection only
+	collection := strings.TrimSpace(ctx.PostForm("collection"))
+	if collection == "" {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "document.collection.required"))
+		return
+	}
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	if file.Size > DocumentMaxBytes {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "document.too.large", DocumentMaxBytes))
+		return
+	}
+	reader, err := file.Open()
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "DocumentUpload error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "DocumentUpload error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	text, err := extractText(file.Filename, data)
+	if err != nil {
+		apierror.Fail(ctx, err)
+		return
+	}
+	document, err := chat.indexDocument(ctx, username, collection, file.Filename, int64(len(data)), text)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "DocumentUpload error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data":    document,
+	})
+}
+
+func (chat *ChatService) DocumentList(ctx *gin.Context) {
+	var documents []Document
+	query := chat.account.WithContext(ctx).db.Where("username = ?", ctx.GetString("username"))
+	if collection, ok := ctx.GetQuery("collection"); ok {
+		query = query.Where("collection = ?", collection)
+	}
+	if err := query.Order("id desc").Find(&documents).Error; err != nil {
+		klog.FromContext(ctx).Error(err, "DocumentList error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data":    documents,
+	})
+}
+
+func (chat *ChatService) DocumentDelete(ctx *gin.Context) {
+	var document Document
+	result := chat.account.WithContext(ctx).db.Where("id = ? AND username = ?", ctx.Param("id"), ctx.GetString("username")).First(&document)
+	if result.Error != nil {
+		apierror.Fail(ctx, apierror.Errorf(apierror.NotFound, "document.not.found"))
+		return
+	}
+	err := chat.account.WithContext(ctx).db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("document_id = ?", document.ID).Delete(&DocumentChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&document).Error
+	})
+	chat.vectors.Delete(vectorsKey(document.Username, document.Collection))
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "DocumentDelete error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data":    nil,
+	})
+}
+
+func extractText(name string, data []byte) (text string, err error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pdf":
+		defer func() {
+			// the pdf reader panics on some malformed files
+			if r := recover(); r != nil {
+				err = apierror.Errorf(apierror.InvalidRequest, "document.pdf.error", r)
+			}
+		}()
+		reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return "", err
+		}
+		plain, err := reader.GetPlainText()
+		if err != nil {
+			return "", err
+		}
+		content, err := io.ReadAll(plain)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	case ".txt", ".md", ".markdown", "":
+		if !utf8.Valid(data) {
+			return "", apierror.Errorf(apierror.InvalidRequest, "document.not.utf8")
+		}
+		return string(data), nil
+	default:
+		return "", apierror.Errorf(apierror.InvalidRequest, "document.unsupported.type", filepath.Ext(name))
+	}
+}
+
+// splitText cuts text into chunks of about DocumentChunkRunes runes on paragraph boundaries
+func splitText(text string) []string {
+	chunks := []string{}
+	var current strings.Builder
+	flush := func() {
+		if chunk := strings.TrimSpace(current.String()); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+	}
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		runes := []rune(strings.TrimSpace(paragraph))
+		for len(runes) > DocumentChunkRunes {
+			flush()
+			current.WriteString(string(runes[:DocumentChunkRunes]))
+			flush()
+			runes = runes[DocumentChunkRunes:]
+		}
+		if utf8.RuneCountInString(current.String())+len(runes) > DocumentChunkRunes {
+			flush()
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(string(runes))
+	}
+	flush()
+	return chunks
+}
+
+func (chat *ChatService) indexDocument(ctx context.Context, username, collection, name string, size int64, text string) (Document, error) {
+	contents := splitText(text)
+	if len(contents) == 0 {
+		return Document{}, apierror.Errorf(apierror.InvalidRequest, "document.no.text")
+	}
+	messages := make([]openai.ChatCompletionMessage, 0, len(contents))
+	for _, content := range contents {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: content,
+		})
+	}
+	counts, _, err := tokenizer.GetTokenCounts(ctx, messages, chat.params().Model)
+	if err != nil {
+		return Document{}, err
+	}
+	chunks := make([]DocumentChunk, 0, len(contents))
+	var total int64
+	for i, content := range contents {
+		tokenCount := counts[i]
+		total += int64(tokenCount)
+		chunks = append(chunks, DocumentChunk{
+			Username:   username,
+			Collection: collection,
+			Seq:        i,
+			Content:    content,
+			Tokens:     tokenCount,
+		})
+	}
+	for start := 0; start < len(chunks); start += DocumentEmbedBatch {
+		end := start + DocumentEmbedBatch
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		// the chunks are kept as uploaded, only the embedding api gets them redacted
+		inputs := make([]string, 0, end-start)
+		for _, content := range contents[start:end] {
+			inputs = append(inputs, chat.redactor.Redact(content, redaction.NewMapping()))
+		}
+		vectors, err := chat.embed(ctx, username, inputs)
+		if err != nil {
+			return Document{}, err
+		}
+		for i, vector := range vectors {
+			chunks[start+i].Embedding = encodeVector(vector)
+		}
+	}
+
+	document := Document{
+		Username:   username,
+		Collection: collection,
+		Name:       name,
+		Size:       size,
+		Chunks:     len(chunks),
+		Tokens:     total,
+	}
+	err = chat.account.WithContext(ctx).db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&document).Error; err != nil {
+			return err
+		}
+		for i := range chunks {
+			chunks[i].DocumentID = document.ID
+		}
+		return tx.CreateInBatches(chunks, 100).Error
+	})
+	chat.vectors.Delete(vectorsKey(username, collection))
+	return document, err
+}
+
+// embed returns the vectors of inputs in order, the embedding tokens are billed to the user
+func (chat *ChatService) embed(ctx context.Context, username string, inputs []string) ([][]float32, error) {
+	rsp, err := chat.client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: inputs,
+		Model: openai.EmbeddingModel(chat.params().EmbeddingModel),
+	})
+	if err != nil {
+		return nil, upstreamError(err, err)
+	}
+	if len(rsp.Data) != len(inputs) {
+		return nil, fmt.Errorf("embedding response has %d vectors for %d inputs", len(rsp.Data), len(inputs))
+	}
+	vectors := make([][]float32, len(inputs))
+	for _, item := range rsp.Data {
+		if item.Index < 0 || item.Index >= len(inputs) {
+			return nil, fmt.Errorf("embedding response index %d out of range", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	if err := chat.recordUsage(ctx, UsageRecord{
+		Username:     username,
+		Model:        chat.params().EmbeddingModel,
+		PromptTokens: int64(rsp.Usage.PromptTokens),
+		Source:       UsageSourceUpstream,
+	}); err != nil {
+		klog.FromContext(ctx).Error(err, "embed error")
+	}
+	return vectors, nil
+}
+
+// retrieve embeds the prompt and returns the best chunks of the collection within the retrieval token budget
+// counted for model, the excerpts are redacted into mapping
+func (chat *ChatService) retrieve(ctx context.Context, username, collection, prompt, model string, mapping *redaction.Mapping) (openai.ChatCompletionMessage, int, error) {
+	db := chat.account.WithContext(ctx).db
+	chunks, err := chat.collectionVectors(db, username, collection)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, 0, err
+	}
+	if len(chunks) == 0 || prompt == "" {
+		return openai.ChatCompletionMessage{}, 0, nil
+	}
+	vectors, err := chat.embed(ctx, username, []string{prompt})
+	if err != nil {
+		return openai.ChatCompletionMessage{}, 0, err
+	}
+	query := vectors[0]
+	scores := make([]float64, len(chunks))
+	for i, chunk := range chunks {
+		scores[i] = cosine(query, chunk.Vector)
+	}
+	order := make([]int, len(chunks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	numTokens, picked := 0, []int64{}
+	for _, i := range order {
+		if len(picked) >= chat.params().RetrievalTopK {
+			break
+		}
+		if numTokens+chunks[i].Tokens > chat.params().RetrievalTokens {
+			continue
+		}
+		numTokens += chunks[i].Tokens
+		picked = append(picked, chunks[i].ID)
+	}
+	if len(picked) == 0 {
+		return openai.ChatCompletionMessage{}, 0, nil
+	}
+	var contents []DocumentChunk
+	if err := db.Select("id", "content").Where("id IN ?", picked).Find(&contents).Error; err != nil {
+		return openai.ChatCompletionMessage{}, 0, err
+	}
+	byID := make(map[int64]string, len(contents))
+	for _, chunk := range contents {
+		byID[chunk.ID] = chunk.Content
+	}
+	var content strings.Builder
+	content.WriteString("Answer with the help of the following excerpts from the user's documents when they are relevant.\n")
+	for i, id := range picked {
+		fmt.Fprintf(&content, "\n[excerpt %d]\n%s\n", i+1, chat.redactor.Redact(byID[id], mapping))
+	}
+	message := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: content.String(),
+	}
+	tokenCount, _, err := tokenizer.GetTokenCount(ctx, message, model)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, 0, err
+	}
+	return message, tokenCount, nil
+}
+
+// collectionVectors returns the decoded embeddings of the collection, they are kept in memory until
+// a document of the collection is added or deleted
+func (chat *ChatService) collectionVectors(db *gorm.DB, username, collection string) ([]chunkVector, error) {
+	key := vectorsKey(username, collection)
+	if item := chat.vectors.Get(key); item != nil && !item.Expired() {
+		return item.Value(), nil
+	}
+	var chunks []DocumentChunk
+	// the contents are loaded for the picked chunks only
+	if err := db.Select("id", "tokens", "embedding").Where("username = ? AND collection = ?", username, collection).Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	vectors := make([]chunkVector, 0, len(chunks))
+	for _, chunk := range chunks {
+		vectors = append(vectors, chunkVector{ID: chunk.ID, Tokens: chunk.Tokens, Vector: decodeVector(chunk.Embedding)})
+	}
+	chat.vectors.Set(key, vectors, DocumentVectorsTTL)
+	return vectors, nil
+}
+
+func encodeVector(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return data
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	paragraph := func(n int) string { return strings.Repeat("文", n) }
+	tests := []struct {
+		name string
+		text string
+		want []int // runes of each chunk
+	}{
+		{"empty", "", []int{}},
+		{"blank", " \n\n \r\n", []int{}},
+		{"short paragraphs", "a\n\nb", []int{4}},
+		{"windows line ends", "a\r\n\r\nb", []int{4}},
+		{"full chunk", paragraph(700) + "\n\n" + paragraph(700), []int{700, 700}},
+		{"long paragraph", paragraph(2500), []int{1200, 1200, 100}},
+		{"after a short one", "a\n\n" + paragraph(1300), []int{1, 1200, 100}},
+	}
+	for _, tt := range tests {
+		chunks := splitText(tt.text)
+		got := []int{}
+		for _, chunk := range chunks {
+			got = append(got, utf8.RuneCountInString(chunk))
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: splitText() chunks = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: splitText() chunks = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
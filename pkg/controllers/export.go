@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/tokenizer"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	openai "github.com/sashabaranov/go-openai"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ChatImportMaxMessages = 500
+)
+
+type ChatThread struct {
+	Messages []openai.ChatCompletionMessage `json:"messages"`
+}
+
+var threadTemplate = template.Must(template.New("thread").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8" />
+<title>Conversation {{.ID}}</title>
+<style>
+body { max-width: 800px; margin: 0 auto; font-family: sans-serif; }
+.message { margin: 16px 0; padding: 12px; border-radius: 6px; white-space: pre-wrap; }
+.user { background: #e8f4ff; }
+.assistant { background: #f4f4f4; }
+.system { background: #fff8e1; }
+.role { font-weight: bold; margin-bottom: 6px; }
+</style>
+</head>
+<body>
+{{range .Messages}}<div class="message {{.Role}}"><div class="role">{{.Role}}{{if .Name}} ({{.Name}}){{end}}</div>{{.Text}}{{range .Images}}<div><img src="{{.}}" style="max-width: 100%;" /></div>{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+func (chat *ChatService) ChatExport(ctx *gin.Context) {
+	id := ctx.Param("id")
+	// the messages of another user above a reply to their conversation are left out
+	thread := chat.getThread(id, ctx.GetString("username"))
+	if len(thread) == 0 {
+		apierror.Fail(ctx, apierror.Errorf(apierror.NotFound, "export.not.found"))
+		return
+	}
+	messages := make([]openai.ChatCompletionMessage, 0, len(thread))
+	for _, item := range thread {
+		messages = append(messages, item.completionMessage())
+	}
+
+	format := ctx.DefaultQuery("format", "markdown")
+	switch format {
+	case "json":
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=conversation-%s.json", id))
+		ctx.JSON(http.StatusOK, ChatThread{Messages: messages})
+	case "markdown", "md":
+		var buf strings.Builder
+		for _, item := range thread {
+			fmt.Fprintf(&buf, "### %s\n\n%s\n\n", item.Role, item.Text)
+			for i, url := range item.Images {
+				fmt.Fprintf(&buf, "![image-%d](%s)\n\n", i+1, url)
+			}
+		}
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=conversation-%s.md", id))
+		ctx.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(buf.String()))
+	case "html":
+		var buf bytes.Buffer
+		views := make([]gin.H, 0, len(thread))
+		for _, item := range thread {
+			// images are validated data urls, mark them safe for the img src attribute
+			images := make([]template.URL, 0, len(item.Images))
+			for _, url := range item.Images {
+				images = append(images, template.URL(url))
+			}
+			views = append(views, gin.H{"Role": item.Role, "Name": item.Name, "Text": item.Text, "Images": images})
+		}
+		if err := threadTemplate.Execute(&buf, gin.H{"ID": id, "Messages": views}); err != nil {
+			klog.FromContext(ctx).Error(err, "ChatExport error")
+			apierror.Fail(ctx, err)
+			return
+		}
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=conversation-%s.html", id))
+		ctx.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	default:
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "export.unsupported.format", format))
+	}
+}
+
+func (chat *ChatService) ChatImport(ctx *gin.Context) {
+	payload := ChatThread{}
+	if err := ctx.BindJSON(&payload); err != nil {
+		klog.FromContext(ctx).Error(err, "ChatImport error")
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	if len(payload.Messages) == 0 || len(payload.Messages) > ChatImportMaxMessages {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "import.count", ChatImportMaxMessages))
+		return
+	}
+	username := ctx.GetString("username")
+	user, err := chat.account.WithContext(ctx).CheckUser(username)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "ChatImport error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	model, _, _, _, _ := parseModelParams(user.Model)
+	if model == "" {
+		model = chat.params().Model
+	}
+
+	thread := make([]ChatMessage, 0, len(payload.Messages))
+	counted, texts := []int{}, []openai.ChatCompletionMessage{}
+	parentMessageId := ""
+	for i, item := range payload.Messages {
+		switch item.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant:
+		default:
+			apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "import.role", i, item.Role))
+			return
+		}
+		text, images := item.Content, []string{}
+		for _, part := range item.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeText {
+				text += part.Text
+			}
+			if part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil {
+				images = append(images, part.ImageURL.URL)
+			}
+		}
+		images, err := chat.resolveImages(username, images)
+		if err != nil {
+			apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "import.message.error", i, err))
+			return
+		}
+		if text == "" && len(images) == 0 {
+			apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "import.empty", i))
+			return
+		}
+		if text != "" {
+			counted = append(counted, len(thread))
+			texts = append(texts, openai.ChatCompletionMessage{
+				Role:    item.Role,
+				Content: text,
+				Name:    item.Name,
+			})
+		}
+		message := ChatMessage{
+			ID:              uuid.New().String(),
+			Role:            item.Role,
+			Text:            text,
+			Name:            item.Name,
+			Images:          images,
+			TokenCount:      imageTokenCount(images),
+			ParentMessageId: parentMessageId,
+			Username:        username,
+		}
+		thread = append(thread, message)
+		parentMessageId = message.ID
+	}
+	counts, _, err := tokenizer.GetTokenCounts(ctx, texts, model)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "ChatImport error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	for i, index := range counted {
+		thread[index].TokenCount += counts[i]
+	}
+	for _, message := range thread {
+		chat.store.Set(message.ID, message, chat.params().ChatSessionTTL)
+		chat.addBranch(message)
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data": gin.H{
+			"id":    parentMessageId,
+			"count": len(thread),
+		},
+	})
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/tokenizer"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	openai "github.com/sashabaranov/go-openai"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ChatMaxImages     = 4
+	ChatMaxImageBytes = 10 << 20
+)
+
+type ChatImage struct {
+	Username string
+	URL      string
+}
+
+// ChatUploadImage stores an uploaded image for the chat session and returns its id for the images option
+func (chat *ChatService) ChatUploadImage(ctx *gin.Context) {
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	if file.Size > ChatMaxImageBytes {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "image.too.large", ChatMaxImageBytes))
+		return
+	}
+	reader, err := file.Open()
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "ChatUploadImage error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, ChatMaxImageBytes))
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "ChatUploadImage error")
+		apierror.Fail(ctx, err)
+		return
+	}
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "image.unsupported.type", mimeType))
+		return
+	}
+	id := "img-" + uuid.New().String()
+	chat.images.Set(id, ChatImage{
+		Username: ctx.GetString("username"),
+		URL:      fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)),
+	}, chat.params().ChatSessionTTL)
+	ctx.JSON(200, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data": gin.H{
+			"id": id,
+		},
+	})
+}
+
+// resolveImages turns upload ids and data urls of a request into data urls
+func (chat *ChatService) resolveImages(username string, images []string) ([]string, error) {
+	if len(images) > ChatMaxImages {
+		return nil, apierror.Errorf(apierror.InvalidRequest, "image.too.many", ChatMaxImages)
+	}
+	urls := make([]string, 0, len(images))
+	for _, item := range images {
+		if strings.HasPrefix(item, "data:image/") {
+			if _, err := decodeDataURL(item); err != nil {
+				return nil, err
+			}
+			urls = append(urls, item)
+			continue
+		}
+		cached := chat.images.Get(item)
+		if cached == nil || cached.Expired() || cached.Value().Username != username {
+			return nil, apierror.Errorf(apierror.InvalidRequest, "image.not.found", item)
+		}
+		urls = append(urls, cached.Value().URL)
+	}
+	return urls, nil
+}
+
+func decodeDataURL(url string) ([]byte, error) {
+	_, encoded, ok := strings.Cut(url, ";base64,")
+	if !ok {
+		return nil, apierror.Errorf(apierror.InvalidRequest, "image.not.data.url")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > ChatMaxImageBytes {
+		return nil, apierror.Errorf(apierror.InvalidRequest, "image.too.large", ChatMaxImageBytes)
+	}
+	return data, nil
+}
+
+// imageTokenCount sums the vision tokens of the images, unknown formats are billed at the largest size
+func imageTokenCount(images []string) int {
+	count := 0
+	for _, url := range images {
+		width, height := 0, 0
+		if data, err := decodeDataURL(url); err == nil {
+			if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+				width, height = config.Width, config.Height
+			}
+		}
+		count += tokenizer.GetImageTokenCount(width, height, string(openai.ImageURLDetailAuto))
+	}
+	return count
+}
+
+// completionMessage converts a stored message to the upstream format, images are sent as multi-part content
+func (message ChatMessage) completionMessage() openai.ChatCompletionMessage {
+	if len(message.Images) == 0 {
+		return openai.ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Text,
+			Name:    message.Name,
+		}
+	}
+	return openai.ChatCompletionMessage{
+		Role:         message.Role,
+		MultiContent: multiContent(message.Text, message.Images),
+		Name:         message.Name,
+	}
+}
+
+func multiContent(text string, images []string) []openai.ChatMessagePart {
+	parts := []openai.ChatMessagePart{}
+	if text != "" {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeText,
+			Text: text,
+		})
+	}
+	for _, url := range images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL:    url,
+				Detail: openai.ImageURLDetailAuto,
+			},
+		})
+	}
+	return parts
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+)
+
+const InviteCodePrefix = "inv-"
+
+// InviteCode lets up to MaxUses people register themselves before it expires, each new user gets
+// Balance tokens and the Models allowlist
+type InviteCode struct {
+	ID        int64      `gorm:"column:id;primaryKey;autoIncrement"`
+	Code      string     `gorm:"column:code;type:varchar(64);not null;unique"`
+	Balance   int64      `gorm:"column:balance;not null;default:0"`
+	MaxUses   int64      `gorm:"column:max_uses;not null;default:1"`
+	Uses      int64      `gorm:"column:uses;not null;default:0"`
+	Models    string     `gorm:"column:models;type:varchar(1000);not null;default:''"`
+	ExpiresAt *time.Time `gorm:"column:expires_at"` // nil never expires
+	CreatedAt time.Time  `gorm:"column:created_at"`
+}
+
+func (InviteCode) TableName() string {
+	return "invite_codes"
+}
+
+// CreateInvite returns a new invite code for maxUses registrations within days, 0 days never expires
+func (ac *AccountService) CreateInvite(balance, maxUses int64, days int, models string) (InviteCode, error) {
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	if days < 0 {
+		return InviteCode{}, apierror.Errorf(apierror.InvalidRequest, "invite.days.invalid")
+	}
+	bts := make([]byte, 12)
+	if _, err := rand.Read(bts); err != nil {
+		return InviteCode{}, err
+	}
+	allowed := []string{}
+	for _, model := range strings.Split(models, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			allowed = append(allowed, model)
+		}
+	}
+	invite := InviteCode{
+		Code:    InviteCodePrefix + hex.EncodeToString(bts),
+		Balance: balance,
+		MaxUses: maxUses,
+		Models:  strings.Join(allowed, ","),
+	}
+	if days > 0 {
+		expires := time.Now().AddDate(0, 0, days)
+		invite.ExpiresAt = &expires
+	}
+	err := ac.db.Create(&invite).Error
+	return invite, err
+}
+
+func (ac *AccountService) ListInvites() ([]InviteCode, error) {
+	var invites []InviteCode
+	result := ac.db.Order("id").Find(&invites)
+	return invites, result.Error
+}
+
+// Register creates the user with the balance and the model allowlist of the invite code, the use of
+// the code is counted in the same transaction so a code is never used more than MaxUses times
+func (ac *AccountService) Register(code, username, password string) error {
+	return ac.db.Transaction(func(tx *gorm.DB) error {
+		var invite InviteCode
+		if err := tx.Where("code = ?", code).First(&invite).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.Errorf(apierror.NotFound, "invite.not.found")
+			}
+			return err
+		}
+		if invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt) {
+			return apierror.Errorf(apierror.InvalidRequest, "invite.expired")
+		}
+		result := tx.Model(&InviteCode{}).Where("id = ? AND uses < max_uses", invite.ID).Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return apierror.Errorf(apierror.InvalidRequest, "invite.used.up")
+		}
+		scoped := &AccountService{db: tx}
+		if err := scoped.CreateUser(username, password, invite.Balance); err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("username = ?", username).Update("models", invite.Models).Error
+	})
+}
+
+type RegisterPayload struct {
+	Invite   string `json:"invite"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RegisterProcess serves the public registration, check validates the username and password
+func (ac *AccountService) RegisterProcess(check func(username, password string) error) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ac := ac.WithContext(ctx)
+		payload := RegisterPayload{}
+		if err := ctx.BindJSON(&payload); err != nil {
+			klog.FromContext(ctx).Error(err, "RegisterProcess error")
+			apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+			return
+		}
+		if err := check(payload.Username, payload.Password); err != nil {
+			apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+			return
+		}
+		if err := ac.Register(strings.TrimSpace(payload.Invite), payload.Username, payload.Password); err != nil {
+			klog.FromContext(ctx).Info("register failed", "username", payload.Username, "err", err)
+			apierror.Fail(ctx, err)
+			return
+		}
+		klog.FromContext(ctx).Info("user registered", "username", payload.Username)
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":  "Success",
+			"message": "success",
+			"data":    nil,
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+)
+
+func init() {
+	i18n.Register(i18n.ZhCN, map[string]string{
+		"account.exists":                "账户名存在",
+		"account.not.found":             "账户不存在",
+		"apikey.too.many":               "API Key不能超过%d个",
+		"apikey.not.found":              "API Key不存在",
+		"chat.balance.insufficient":     "Token余额不足,本次请求需要%d,剩余%d",
+		"chat.context.too.long":         "模型最大上下文为%d个Token,本次消息需要%d个Token",
+		"chat.upstream.error":           "OpenAI Event Error %v",
+		"chat.marshal.error":            "OpenAI Event Marshal Error %v",
+		"chat.shutting.down":            "服务正在重启,请稍后再试",
+		"chat.model.not.allowed":        "不能使用模型%s,可用模型: %s",
+		"chat.message.not.found":        "消息不存在或已过期",
+		"chat.regenerate.role":          "只能重新生成助手回复",
+		"chat.edit.role":                "只能编辑用户消息,且内容不能为空",
+		"stream.not.found":              "对话流不存在或已过期",
+		"stream.not.running":            "对话流不存在或已结束",
+		"image.too.large":               "图片不能超过%d字节",
+		"image.unsupported.type":        "不支持的图片类型%s",
+		"image.too.many":                "每条消息最多%d张图片",
+		"image.not.found":               "图片%s不存在或已过期",
+		"image.not.data.url":            "图片必须是base64 data url",
+		"document.too.large":            "文档不能超过%d字节",
+		"document.not.found":            "文档不存在",
+		"document.pdf.error":            "解析pdf失败 %v",
+		"document.not.utf8":             "文档必须是utf-8文本",
+		"document.unsupported.type":     "不支持的文档类型%s,请使用txt、md或pdf",
+		"document.no.text":              "文档没有文本内容",
+		"document.collection.required":  "请指定文档集合collection",
+		"export.not.found":              "会话不存在或已过期",
+		"export.unsupported.format":     "不支持的导出格式%s",
+		"import.count":                  "消息数量必须在1到%d之间",
+		"import.role":                   "第%d条消息角色%s不支持",
+		"import.message.error":          "第%d条消息: %s",
+		"import.empty":                  "第%d条消息内容为空",
+		"moderation.blocked.prompt":     "消息包含不允许的内容,已被拦截",
+		"moderation.blocked.completion": "回复包含不允许的内容,已被停止",
+		"moderation.warning":            "内容可能违反使用规范,已被记录",
+		"invite.not.found":              "邀请码不存在",
+		"invite.expired":                "邀请码已过期",
+		"invite.used.up":                "邀请码已用完",
+		"invite.days.invalid":           "有效天数不能为负数",
+		"voucher.not.found":             "充值卡不存在",
+		"voucher.redeemed":              "充值卡已被使用",
+		"voucher.expired":               "充值卡已过期",
+		"voucher.unlimited":             "账户不限额度,无需充值",
+		"voucher.number.invalid":        "充值卡数量必须在1到%d之间",
+		"voucher.amount.invalid":        "充值卡面额必须大于0",
+		"voucher.batch.invalid":         "批次名只能包含字母、数字、-和_,最长32位",
+		"voucher.batch.not.found":       "批次不存在",
+		"plan.name.invalid":             "套餐名不能为空",
+		"plan.allowance.invalid":        "套餐额度必须大于0",
+		"plan.period.invalid":           "套餐周期%s不支持,请使用day、week或month",
+		"plan.not.found":                "套餐不存在",
+		"grant.amount.invalid":          "赠送Token数必须大于0",
+		"grant.days.invalid":            "赠送Token的有效天数必须大于0",
+	})
+	i18n.Register(i18n.En, map[string]string{
+		"account.exists":                "Account name already exists",
+		"account.not.found":             "Account not found",
+		"apikey.too.many":               "At most %d API keys are allowed",
+		"apikey.not.found":              "API key not found",
+		"chat.balance.insufficient":     "Insufficient token balance, this request needs %d, %d left",
+		"chat.context.too.long":         "This model's maximum context length is %d tokens, you requested %d tokens in the messages",
+		"chat.upstream.error":           "OpenAI Event Error %v",
+		"chat.marshal.error":            "OpenAI Event Marshal Error %v",
+		"chat.shutting.down":            "The server is restarting, please try again later",
+		"chat.model.not.allowed":        "Model %s is not allowed, allowed models: %s",
+		"chat.message.not.found":        "Message not found or expired",
+		"chat.regenerate.role":          "Only assistant replies can be regenerated",
+		"chat.edit.role":                "Only user messages can be edited with a non-empty prompt",
+		"stream.not.found":              "Stream not found or expired",
+		"stream.not.running":            "Stream not found or finished",
+		"image.too.large":               "Image must be smaller than %d bytes",
+		"image.unsupported.type":        "Unsupported image type %s",
+		"image.too.many":                "At most %d images can be attached to a message",
+		"image.not.found":               "Image %s not found or expired",
+		"image.not.data.url":            "Image must be a base64 data url",
+		"document.too.large":            "Document must be smaller than %d bytes",
+		"document.not.found":            "Document not found",
+		"document.pdf.error":            "Parse pdf error %v",
+		"document.not.utf8":             "Document must be utf-8 text",
+		"document.unsupported.type":     "Unsupported document type %s, use txt, md or pdf",
+		"document.no.text":              "Document has no text",
+		"document.collection.required":  "Document collection is required",
+		"export.not.found":              "Conversation not found or expired",
+		"export.unsupported.format":     "Unsupported format %s",
+		"import.count":                  "Messages count must be between 1 and %d",
+		"import.role":                   "Message %d has unsupported role %s",
+		"import.message.error":          "Message %d: %s",
+		"import.empty":                  "Message %d has empty content",
+		"moderation.blocked.prompt":     "The message was blocked by content moderation",
+		"moderation.blocked.completion": "The reply was stopped by content moderation",
+		"moderation.warning":            "This content may violate the usage policy and has been recorded",
+		"invite.not.found":              "Invite code not found",
+		"invite.expired":                "The invite code has expired",
+		"invite.used.up":                "The invite code has been used up",
+		"invite.days.invalid":           "Days must not be negative",
+		"voucher.not.found":             "Voucher not found",
+		"voucher.redeemed":              "The voucher has already been redeemed",
+		"voucher.expired":               "The voucher has expired",
+		"voucher.unlimited":             "The account has no balance limit",
+		"voucher.number.invalid":        "The number of vouchers must be between 1 and %d",
+		"voucher.amount.invalid":        "The voucher amount must be positive",
+		"voucher.batch.invalid":         "The batch name may only contain letters, digits, - and _, up to 32 characters",
+		"voucher.batch.not.found":       "Batch not found",
+		"plan.name.invalid":             "The plan name must not be empty",
+		"plan.allowance.invalid":        "The plan allowance must be positive",
+		"plan.period.invalid":           "Plan period %s is not supported, use day, week or month",
+		"plan.not.found":                "Plan not found",
+		"grant.amount.invalid":          "The grant amount must be positive",
+		"grant.days.invalid":            "The days of a grant must be positive",
+	})
+}
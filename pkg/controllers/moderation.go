@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+	"github.com/Arvintian/chatgpt-web/pkg/logging"
+	"github.com/Arvintian/chatgpt-web/pkg/moderation"
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
+	openai "github.com/sashabaranov/go-openai"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ModerationCheckBytes   = 500 // the growing completion is checked again after this many new bytes
+	ModerationExcerptRunes = 1000
+	ModerationListLimit    = 100
+)
+
+// ModerationEvent is a flag raised by a checker, kept for ops review
+type ModerationEvent struct {
+	ID         int64     `gorm:"column:id;primaryKey;autoIncrement"`
+	Username   string    `gorm:"column:username;not null;index"`
+	MessageID  string    `gorm:"column:message_id;not null;default:''"`
+	Stage      string    `gorm:"column:stage;not null;default:''"` // prompt or completion
+	Checker    string    `gorm:"column:checker;not null;default:''"`
+	Action     string    `gorm:"column:action;not null;default:''"`     // block, warn or log
+	Categories string    `gorm:"column:categories;not null;default:''"` // comma separated
+	Excerpt    string    `gorm:"column:excerpt;type:varchar(4000);not null;default:''"`
+	CreatedAt  time.Time `gorm:"column:created_at;index"`
+}
+
+func (ModerationEvent) TableName() string {
+	return "moderation_events"
+}
+
+func (ac *AccountService) RecordModeration(event ModerationEvent) error {
+	return ac.db.Create(&event).Error
+}
+
+// ListModeration returns the latest events, of a user when username is set
+func (ac *AccountService) ListModeration(username string, limit int) ([]ModerationEvent, error) {
+	var events []ModerationEvent
+	query := ac.db.Order("id desc").Limit(limit)
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+	result := query.Find(&events)
+	return events, result.Error
+}
+
+// newModeration builds the pipeline of the configured checkers, the keywords file first
+func newModeration(client *openai.Client, params ChatCompletionParams) (*moderation.Pipeline, error) {
+	pipeline := moderation.NewPipeline()
+	if params.ModerationKeywords != "" {
+		keywords, err := moderation.LoadKeywords(params.ModerationKeywords)
+		if err != nil {
+			return nil, err
+		}
+		if err := addModerationRule(pipeline, keywords, params.ModerationKeywordsAction, params.ModerationKeywordsStages); err != nil {
+			return nil, err
+		}
+	}
+	if params.ModerationOpenAIAction != "" {
+		checker := moderation.NewOpenAI(client, params.ModerationOpenAIModel)
+		if err := addModerationRule(pipeline, checker, params.ModerationOpenAIAction, params.ModerationOpenAIStages); err != nil {
+			return nil, err
+		}
+	}
+	return pipeline, nil
+}
+
+func addModerationRule(pipeline *moderation.Pipeline, checker moderation.Checker, action string, stages []string) error {
+	a, err := moderation.ParseAction(action)
+	if err != nil {
+		return err
+	}
+	s, err := moderation.ParseStages(stages)
+	if err != nil {
+		return err
+	}
+	klog.Infof("enable moderation %s: %s on %v", checker.Name(), a, s)
+	pipeline.Add(moderation.Rule{Checker: checker, Action: a, Stages: s})
+	return nil
+}
+
+// moderate checks the text of a stage, records the new flags and returns the strongest action of them,
+// with an error when a checker blocks. seen keeps the flags already recorded for a completion,
+// which is checked again while it grows.
+func (chat *ChatService) moderate(ctx context.Context, username, id string, stage moderation.Stage, text string, seen map[string]bool) (moderation.Action, error) {
+	if !chat.moderation.Has(stage) {
+		return "", nil
+	}
+	flags := []moderation.Flag{}
+	for _, flag := range chat.moderation.Check(ctx, stage, text) {
+		key := flag.Checker + ":" + strings.Join(flag.Categories, ",")
+		if seen != nil {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		flags = append(flags, flag)
+	}
+	for _, flag := range flags {
+		klog.FromContext(ctx).Info("moderation flagged", "id", id, "username", username, "stage", stage, "checker", flag.Checker, "action", flag.Action, "categories", flag.Categories)
+		if err := chat.account.WithContext(ctx).RecordModeration(ModerationEvent{
+			Username:   username,
+			MessageID:  id,
+			Stage:      string(stage),
+			Checker:    flag.Checker,
+			Action:     string(flag.Action),
+			Categories: strings.Join(flag.Categories, ","),
+			Excerpt:    excerpt(text, ModerationExcerptRunes),
+		}); err != nil {
+			klog.FromContext(ctx).Error(err, "record moderation error", "id", id)
+		}
+	}
+	action := moderation.Strongest(flags)
+	if action == moderation.Block {
+		return action, apierror.Errorf(apierror.ContentFlagged, "moderation.blocked."+string(stage))
+	}
+	return action, nil
+}
+
+// moderateCompletion checks the reply so far, a warning goes to the client with frame
+func (chat *ChatService) moderateCompletion(st *chatStream, frame *chatFrame, text string, seen map[string]bool) error {
+	// the last check runs after the stream ended, which may have been canceled
+	ctx := tracing.Detach(st.ctx, logging.Detach(st.ctx))
+	action, err := chat.moderate(ctx, st.username, frame.ID, moderation.Completion, text, seen)
+	if action == moderation.Warn {
+		frame.Warning = i18n.T(st.locale, "moderation.warning")
+	}
+	return err
+}
+
+// excerpt keeps the last n runes of text, where a growing completion got flagged
+func excerpt(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return "..." + string(runes[len(runes)-n:])
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+)
+
+const (
+	PlanDaily   = "day"
+	PlanWeekly  = "week"
+	PlanMonthly = "month"
+
+	ScheduleInterval = time.Minute
+)
+
+// Plan is an allowance of tokens per calendar period in the server time zone
+type Plan struct {
+	ID        int64     `gorm:"column:id;primaryKey;autoIncrement"`
+	Name      string    `gorm:"column:name;type:varchar(64);not null;unique"`
+	Allowance int64     `gorm:"column:allowance;not null"`
+	Period    string    `gorm:"column:period;type:varchar(16);not null"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (Plan) TableName() string {
+	return "plans"
+}
+
+// Grant is a top up of Amount tokens for a user that expires, used before the lifetime balance
+type Grant struct {
+	ID        int64     `gorm:"column:id;primaryKey;autoIncrement"`
+	Username  string    `gorm:"column:username;not null;index"`
+	Amount    int64     `gorm:"column:amount;not null"`
+	Used      int64     `gorm:"column:used;not null;default:0"`
+	ExpiresAt time.Time `gorm:"column:expires_at;not null;index"`
+	Expired   bool      `gorm:"column:expired;not null;default:false"` // set by the scheduler
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (Grant) TableName() string {
+	return "grants"
+}
+
+// Allowance is what a user may still use, Balance is negative when a chat overdrew it
+type Allowance struct {
+	Unlimited bool
+	Plan      string
+	PlanLeft  int64
+	Reset     time.Time // end of the current period
+	Grants    int64
+	Balance   int64
+}
+
+// Remaining adds the parts left, an overdrawn balance does not use up the plan or the grants
+func (a Allowance) Remaining() int64 {
+	remaining := int64(0)
+	for _, part := range []int64{a.PlanLeft, a.Grants, a.Balance} {
+		if part > 0 {
+			remaining += part
+		}
+	}
+	return remaining
+}
+
+func periodStart(period string, now time.Time) time.Time {
+	y, m, d := now.Date()
+	switch period {
+	case PlanDaily:
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	case PlanWeekly:
+		day := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	}
+}
+
+func periodEnd(period string, start time.Time) time.Time {
+	switch period {
+	case PlanDaily:
+		return start.AddDate(0, 0, 1)
+	case PlanWeekly:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// periodUsage is the usage of the user in the current period, a period the scheduler has not reset yet counts as new
+func periodUsage(plan Plan, user User, now time.Time) int64 {
+	if user.PeriodStart == nil || user.PeriodStart.Before(periodStart(plan.Period, now)) {
+		return 0
+	}
+	return user.PeriodUsage
+}
+
+// SavePlan creates the plan or changes the allowance and period of the plan with the name
+func (ac *AccountService) SavePlan(name string, allowance int64, period string) (Plan, error) {
+	if name == "" {
+		return Plan{}, apierror.Errorf(apierror.InvalidRequest, "plan.name.invalid")
+	}
+	if allowance <= 0 {
+		return Plan{}, apierror.Errorf(apierror.InvalidRequest, "plan.allowance.invalid")
+	}
+	if period != PlanDaily && period != PlanWeekly && period != PlanMonthly {
+		return Plan{}, apierror.Errorf(apierror.InvalidRequest, "plan.period.invalid", period)
+	}
+	var plan Plan
+	err := ac.db.Where("name = ?", name).First(&plan).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return plan, err
+	}
+	plan.Name, plan.Allowance, plan.Period = name, allowance, period
+	return plan, ac.db.Save(&plan).Error
+}
+
+func (ac *AccountService) ListPlans() ([]Plan, error) {
+	var plans []Plan
+	result := ac.db.Order("id").Find(&plans)
+	return plans, result.Error
+}
+
+// AssignPlan puts the user on the plan with a fresh period, an empty name removes the plan
+func (ac *AccountService) AssignPlan(username, name string) error {
+	user, err := ac.CheckUser(username)
+	if err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"plan_id": 0, "period_usage": 0, "period_start": nil}
+	if name != "" {
+		var plan Plan
+		if err := ac.db.Where("name = ?", name).First(&plan).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.Errorf(apierror.NotFound, "plan.not.found")
+			}
+			return err
+		}
+		updates["plan_id"], updates["period_start"] = plan.ID, periodStart(plan.Period, time.Now())
+	}
+	return ac.db.Model(&User{}).Where("id = ?", user.ID).Updates(updates).Error
+}
+
+// GrantTokens tops up the user with amount tokens expiring after days
+func (ac *AccountService) GrantTokens(username string, amount int64, days int) (Grant, error) {
+	if amount <= 0 {
+		return Grant{}, apierror.Errorf(apierror.InvalidRequest, "grant.amount.invalid")
+	}
+	if days <= 0 {
+		return Grant{}, apierror.Errorf(apierror.InvalidRequest, "grant.days.invalid")
+	}
+	if _, err := ac.CheckUser(username); err != nil {
+		return Grant{}, err
+	}
+	grant := Grant{Username: username, Amount: amount, ExpiresAt: time.Now().AddDate(0, 0, days)}
+	return grant, ac.db.Create(&grant).Error
+}
+
+func (ac *AccountService) ListGrants(username string) ([]Grant, error) {
+	var grants []Grant
+	result := ac.db.Where("username = ?", username).Order("id").Find(&grants)
+	return grants, result.Error
+}
+
+// activeGrants returns the grants of the user with tokens left, the first to expire first
+func activeGrants(db *gorm.DB, username string, now time.Time) ([]Grant, error) {
+	var grants []Grant
+	if err := db.Where("username = ? AND expired = ? AND used < amount", username, false).Order("expires_at").Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	active := grants[:0]
+	for _, grant := range grants {
+		if grant.ExpiresAt.After(now) {
+			active = append(active, grant)
+		}
+	}
+	return active, nil
+}
+
+// AllowanceOf returns the tokens left in the current period of the plan, the grants and the balance of the user
+func (ac *AccountService) AllowanceOf(user User) (Allowance, error) {
+	if user.Balance < 0 {
+		return Allowance{Unlimited: true}, nil
+	}
+	now := time.Now()
+	allowance := Allowance{Balance: user.Balance - user.Usage}
+	if user.PlanID != 0 {
+		var plan Plan
+		err := ac.db.First(&plan, user.PlanID).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return allowance, err
+		}
+		if err == nil {
+			allowance.Plan = plan.Name
+			allowance.Reset = periodEnd(plan.Period, periodStart(plan.Period, now))
+			if left := plan.Allowance - periodUsage(plan, user, now); left > 0 {
+				allowance.PlanLeft = left
+			}
+		}
+	}
+	grants, err := activeGrants(ac.db, user.Username, now)
+	if err != nil {
+		return allowance, err
+	}
+	for _, grant := range grants {
+		allowance.Grants += grant.Amount - grant.Used
+	}
+	return allowance, nil
+}
+
+// RunScheduler resets the period usage of the plans and expires the grants until ctx is done
+func (ac *AccountService) RunScheduler(ctx context.Context) {
+	ticker := time.NewTicker(ScheduleInterval)
+	defer ticker.Stop()
+	for {
+		ac.schedule(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ac *AccountService) schedule(now time.Time) {
+	plans, err := ac.ListPlans()
+	if err != nil {
+		klog.ErrorS(err, "list plans error")
+		return
+	}
+	for _, plan := range plans {
+		start := periodStart(plan.Period, now)
+		result := ac.db.Model(&User{}).Where("plan_id = ? AND (period_start IS NULL OR period_start < ?)", plan.ID, start).
+			Updates(map[string]interface{}{"period_usage": 0, "period_start": start})
+		if result.Error != nil {
+			klog.ErrorS(result.Error, "reset plan error", "plan", plan.Name)
+		} else if result.RowsAffected > 0 {
+			klog.InfoS("plan allowance reset", "plan", plan.Name, "users", result.RowsAffected, "period_start", start)
+		}
+	}
+	result := ac.db.Model(&Grant{}).Where("expired = ? AND expires_at <= ?", false, now).Update("expired", true)
+	if result.Error != nil {
+		klog.ErrorS(result.Error, "expire grants error")
+	} else if result.RowsAffected > 0 {
+		klog.InfoS("grants expired", "grants", result.RowsAffected)
+	}
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAllowanceRemaining(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowance Allowance
+		want      int64
+	}{
+		{"all parts", Allowance{PlanLeft: 100, Grants: 50, Balance: 10}, 160},
+		{"overdrawn balance", Allowance{PlanLeft: 100, Grants: 50, Balance: -500}, 150},
+		{"nothing left", Allowance{Balance: -1}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.allowance.Remaining(); got != tt.want {
+			t.Errorf("%s: Remaining() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	day := func(month time.Month, d int) time.Time { return time.Date(2023, month, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		period string
+		now    time.Time
+		want   time.Time
+	}{
+		{PlanDaily, day(10, 19).Add(15 * time.Hour), day(10, 19)},
+		{PlanWeekly, day(10, 19).Add(15 * time.Hour), day(10, 16)},
+		{PlanWeekly, day(10, 16), day(10, 16)},
+		{PlanWeekly, day(10, 22).Add(23 * time.Hour), day(10, 16)},
+		{PlanWeekly, day(10, 1), day(9, 25)},
+		{PlanMonthly, day(10, 19).Add(15 * time.Hour), day(10, 1)},
+		{PlanMonthly, day(10, 1), day(10, 1)},
+	}
+	for _, tt := range tests {
+		if got := periodStart(tt.period, tt.now); !got.Equal(tt.want) {
+			t.Errorf("periodStart(%s, %v) = %v, want %v", tt.period, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestPeriodUsage(t *testing.T) {
+	now := time.Date(2023, 10, 19, 15, 0, 0, 0, time.UTC)
+	at := func(month time.Month, d int) *time.Time {
+		start := time.Date(2023, month, d, 0, 0, 0, 0, time.UTC)
+		return &start
+	}
+	tests := []struct {
+		name string
+		plan Plan
+		user User
+		want int64
+	}{
+		{"never charged", Plan{Period: PlanMonthly}, User{PeriodUsage: 50}, 0},
+		{"current month", Plan{Period: PlanMonthly}, User{PeriodStart: at(10, 1), PeriodUsage: 50}, 50},
+		{"last month", Plan{Period: PlanMonthly}, User{PeriodStart: at(9, 1), PeriodUsage: 50}, 0},
+		{"current day", Plan{Period: PlanDaily}, User{PeriodStart: at(10, 19), PeriodUsage: 50}, 50},
+		{"yesterday", Plan{Period: PlanDaily}, User{PeriodStart: at(10, 18), PeriodUsage: 50}, 0},
+		{"last week", Plan{Period: PlanWeekly}, User{PeriodStart: at(10, 9), PeriodUsage: 50}, 0},
+	}
+	for _, tt := range tests {
+		if got := periodUsage(tt.plan, tt.user, now); got != tt.want {
+			t.Errorf("%s: periodUsage() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIncUsageConcurrent(t *testing.T) {
+	ac := newTestAccounts(t)
+	if err := ac.CreateUser("alice", "secret1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.SavePlan("basic", 100, PlanMonthly); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.AssignPlan("alice", "basic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.GrantTokens("alice", 100, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ac.IncUsage("alice", 10); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	user, err := ac.CheckUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PeriodUsage != 100 {
+		t.Errorf("period usage = %d, want 100", user.PeriodUsage)
+	}
+	grants, err := ac.ListGrants("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].Used != 100 {
+		t.Errorf("grants = %+v, want 100 used", grants)
+	}
+	if user.Usage != 100 {
+		t.Errorf("usage = %d, want 100", user.Usage)
+	}
+	allowance, err := ac.AllowanceOf(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowance.Remaining() != 0 || allowance.Reset.Before(time.Now()) {
+		t.Errorf("allowance = %+v, want nothing left until the next period", allowance)
+	}
+}
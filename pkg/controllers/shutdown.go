@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const ChatDrainGrace = 5 * time.Second // for the canceled completions to be stored and billed
+
+// Drain stops accepting chats and waits for the completions in flight until ctx is done, the ones
+// left are then canceled, which keeps and bills their partial replies
+func (chat *ChatService) Drain(ctx context.Context) error {
+	chat.drainMu.Lock()
+	chat.draining = true
+	chat.drainMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		chat.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	klog.InfoS("cancel chats at the shutdown deadline", "streams", chat.streams.cancelAll())
+	select {
+	case <-done:
+		return nil
+	case <-time.After(ChatDrainGrace):
+		return fmt.Errorf("chats still running %s after the shutdown deadline", ChatDrainGrace)
+	}
+}
+
+// begin counts a new chat in flight unless the service is draining, under the lock so that
+// no chat is added once Drain waits for them
+func (chat *ChatService) begin() bool {
+	chat.drainMu.Lock()
+	defer chat.drainMu.Unlock()
+	if chat.draining {
+		return false
+	}
+	chat.inflight.Add(1)
+	return true
+}
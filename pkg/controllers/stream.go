@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/Arvintian/chatgpt-web/pkg/redaction"
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ChatStreamRetention = 5 * time.Minute
+)
+
+type chatFrame struct {
+	ID        string
+	Delta     string
+	Detail    openai.ChatCompletionStreamResponse
+	ToolCalls []ChatToolCall // set when tools were invoked, the calls so far
+	Warning   string         // set when moderation warns about the reply
+}
+
+// chatStream buffers the frames of one completion so clients can read it from any offset
+type chatStream struct {
+	sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	username    string
+	locale      string
+	prompt      string
+	mapping     *redaction.Mapping // values redacted from the request
+	cacheVector []float32          // embedding of the prompt for the semantic cache
+	estimated   bool               // the prompt tokens are estimated
+	started     time.Time
+	result      ChatMessage
+	frames      []chatFrame
+	done        bool
+	err         error
+	notify      chan struct{}
+}
+
+func newChatStream(ctx context.Context, cancel context.CancelFunc, username string, result ChatMessage) *chatStream {
+	return &chatStream{
+		ctx:      ctx,
+		cancel:   cancel,
+		username: username,
+		started:  time.Now(),
+		result:   result,
+		notify:   make(chan struct{}),
+	}
+}
+
+func (s *chatStream) append(frame chatFrame) {
+	s.Lock()
+	defer s.Unlock()
+	s.frames = append(s.frames, frame)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *chatStream) finish(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.done, s.err = true, err
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// since returns the frames after offset, when not done wait is closed on the next change
+func (s *chatStream) since(offset int) (frames []chatFrame, done bool, err error, wait chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	if offset < len(s.frames) {
+		frames = s.frames[offset:]
+	}
+	return frames, s.done, s.err, s.notify
+}
+
+// state returns the text, tool calls and moderation warning of the reply before offset
+func (s *chatStream) state(offset int) (string, []ChatToolCall, string) {
+	s.Lock()
+	defer s.Unlock()
+	var text strings.Builder
+	var toolCalls []ChatToolCall
+	warning := s.result.Warning
+	for i := 0; i < offset && i < len(s.frames); i++ {
+		text.WriteString(s.frames[i].Delta)
+		if s.frames[i].ToolCalls != nil {
+			toolCalls = s.frames[i].ToolCalls
+		}
+		if s.frames[i].Warning != "" {
+			warning = s.frames[i].Warning
+		}
+	}
+	return text.String(), toolCalls, warning
+}
+
+// chatStreams indexes the in-flight completions by result message id
+type chatStreams struct {
+	sync.Mutex
+	items map[string]*chatStream
+}
+
+func newChatStreams() *chatStreams {
+	return &chatStreams{
+		items: map[string]*chatStream{},
+	}
+}
+
+func (s *chatStreams) add(id string, stream *chatStream) {
+	s.Lock()
+	defer s.Unlock()
+	s.items[id] = stream
+}
+
+func (s *chatStreams) remove(ids ...string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, id := range ids {
+		delete(s.items, id)
+	}
+}
+
+// cancelAll cancels the completions in flight and returns their number
+func (s *chatStreams) cancelAll() int {
+	s.Lock()
+	defer s.Unlock()
+	canceled := map[*chatStream]bool{}
+	for _, stream := range s.items {
+		if !canceled[stream] {
+			canceled[stream] = true
+			stream.cancel()
+		}
+	}
+	return len(canceled)
+}
+
+func (s *chatStreams) get(id string) (*chatStream, bool) {
+	s.Lock()
+	defer s.Unlock()
+	stream, ok := s.items[id]
+	return stream, ok
+}
+
+// tail writes the frames of st from offset to the client until the completion ends or the client leaves
+func (chat *ChatService) tail(ctx *gin.Context, st *chatStream, offset int) {
+	result := st.result
+	result.Text, result.ToolCalls, result.Warning = st.state(offset)
+	firstChunk := true
+	ctx.Header("Content-type", "application/octet-stream")
+	for {
+		frames, done, err, wait := st.since(offset)
+		for _, frame := range frames {
+			result.ID = frame.ID
+			result.Delta = frame.Delta
+			result.Text += frame.Delta
+			result.Detail = frame.Detail
+			if frame.ToolCalls != nil {
+				result.ToolCalls = frame.ToolCalls
+			}
+			if frame.Warning != "" {
+				result.Warning = frame.Warning
+			}
+			offset++
+
+			bts, err := json.Marshal(result)
+			if err != nil {
+				klog.FromContext(ctx).Error(err, "tail error")
+				apierror.Fail(ctx, apierror.Errorf(apierror.InternalError, "chat.marshal.error", err))
+				return
+			}
+
+			if !firstChunk {
+				ctx.Writer.Write([]byte("\n"))
+			} else {
+				firstChunk = false
+			}
+
+			if _, err := ctx.Writer.Write(bts); err != nil {
+				klog.FromContext(ctx).Error(err, "tail error")
+				return
+			}
+		}
+		ctx.Writer.Flush()
+
+		if done {
+			if err != nil {
+				apierror.Fail(ctx, err)
+			}
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Request.Context().Done():
+			klog.FromContext(ctx).Info("client left chat", "id", result.ID, "offset", offset)
+			return
+		}
+	}
+}
+
+type ChatResumeRequest struct {
+	Offset int `json:"offset"`
+}
+
+// ChatResume replays a completion from offset, the number of chunks the client already received
+func (chat *ChatService) ChatResume(ctx *gin.Context) {
+	payload := ChatResumeRequest{}
+	if err := ctx.BindJSON(&payload); err != nil {
+		klog.FromContext(ctx).Error(err, "ChatResume error")
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	stream, ok := chat.streams.get(ctx.Param("id"))
+	if !ok || stream.username != ctx.GetString("username") {
+		apierror.Fail(ctx, apierror.Errorf(apierror.NotFound, "stream.not.found"))
+		return
+	}
+	if payload.Offset < 0 {
+		payload.Offset = 0
+	}
+	chat.tail(ctx, stream, payload.Offset)
+}
+
+// ChatCancel stops the upstream completion of a running chat-process, the partial reply is kept
+func (chat *ChatService) ChatCancel(ctx *gin.Context) {
+	stream, ok := chat.streams.get(ctx.Param("id"))
+	if !ok || stream.username != ctx.GetString("username") {
+		apierror.Fail(ctx, apierror.Errorf(apierror.NotFound, "stream.not.running"))
+		return
+	}
+	stream.cancel()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "Success",
+		"message": "",
+		"data":    nil,
+	})
+}
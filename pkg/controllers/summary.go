@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Arvintian/chatgpt-web/pkg/redaction"
+	"github.com/Arvintian/chatgpt-web/pkg/tokenizer"
+	"github.com/Arvintian/chatgpt-web/pkg/utils"
+	openai "github.com/sashabaranov/go-openai"
+	"k8s.io/klog/v2"
+)
+
+const summaryPrompt = `Summarize the earlier part of the conversation below so that it can replace the original messages as context.
+Keep facts, decisions, names, code identifiers and open questions. Answer with the summary only, in the language of the conversation.`
+
+// summarize returns a system message with the summary of every message before oldest,
+// the result is cached on oldest so the next turn of the same chain reuses it and the completion is billed to username.
+func (chat *ChatService) summarize(ctx context.Context, username string, oldest *ChatMessage, model string, maxTokens int, mapping *redaction.Mapping) (openai.ChatCompletionMessage, error) {
+	if oldest.Summary != "" {
+		return summaryMessage(oldest.Summary), nil
+	}
+	dropped := []ChatMessage{}
+	previous := ""
+	numTokens := 0
+	parentMessageId := oldest.ParentMessageId
+	for parentMessageId != "" {
+		parentMessage, ok := chat.getMessageByID(parentMessageId)
+		if !ok || parentMessage.Username != username {
+			break
+		}
+		// a message with a summary goes into the transcript with it
+		tokenCount := parentMessage.TokenCount + parentMessage.SummaryTokens
+		if numTokens+tokenCount >= maxTokens-chat.params().ChatSummaryTokens {
+			break
+		}
+		numTokens += tokenCount
+		dropped = append(dropped, parentMessage)
+		if parentMessage.Summary != "" {
+			// everything before this message is already summarized
+			previous = parentMessage.Summary
+			break
+		}
+		parentMessageId = parentMessage.ParentMessageId
+	}
+	if len(dropped) == 0 {
+		return openai.ChatCompletionMessage{}, nil
+	}
+	utils.Reverse(dropped)
+
+	var transcript strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&transcript, "[earlier summary]\n%s\n\n", chat.redactor.Redact(previous, mapping))
+	}
+	for _, item := range dropped {
+		fmt.Fprintf(&transcript, "[%s]\n%s\n\n", item.Role, chat.redactor.Redact(item.Text, mapping))
+	}
+	prompt := chat.params().SummaryPrompt
+	if prompt == "" {
+		prompt = summaryPrompt
+	}
+	rsp, err := chat.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: prompt},
+			{Role: openai.ChatMessageRoleUser, Content: transcript.String()},
+		},
+		MaxTokens:   chat.params().ChatSummaryTokens,
+		Temperature: 0,
+	})
+	if err != nil {
+		return openai.ChatCompletionMessage{}, err
+	}
+	if len(rsp.Choices) == 0 || rsp.Choices[0].Message.Content == "" {
+		return openai.ChatCompletionMessage{}, fmt.Errorf("empty summary response")
+	}
+
+	message := summaryMessage(rsp.Choices[0].Message.Content)
+	tokenCount, estimated, err := tokenizer.GetTokenCount(ctx, message, model)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, err
+	}
+	record := UsageRecord{
+		Username:         username,
+		MessageID:        oldest.ID,
+		Model:            model,
+		PromptTokens:     int64(rsp.Usage.PromptTokens),
+		CompletionTokens: int64(rsp.Usage.CompletionTokens),
+		Source:           UsageSourceUpstream,
+	}
+	if rsp.Usage.TotalTokens == 0 {
+		// the transcript is counted without the summary prompt
+		record.PromptTokens, record.CompletionTokens, record.Source = int64(numTokens), int64(tokenCount), UsageSourceLocal
+		record.Estimated = estimated
+	}
+	if err := chat.recordUsage(ctx, record); err != nil {
+		klog.FromContext(ctx).Error(err, "record summary usage error", "id", oldest.ID)
+	}
+	oldest.Summary = rsp.Choices[0].Message.Content
+	oldest.SummaryTokens = tokenCount
+	chat.store.Set(oldest.ID, *oldest, chat.params().ChatSessionTTL)
+	return message, nil
+}
+
+func summaryMessage(summary string) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: fmt.Sprintf("Summary of the earlier conversation:\n%s", summary),
+	}
+}
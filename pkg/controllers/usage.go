@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	UsageSourceUpstream = "upstream"
+	UsageSourceLocal    = "local"
+	UsageSourceCache    = "cache"
+)
+
+type UsageRecord struct {
+	ID               int64     `gorm:"column:id;primaryKey;autoIncrement"`
+	Username         string    `gorm:"column:username;not null;index"`
+	MessageID        string    `gorm:"column:message_id;not null;default:''"`
+	Model            string    `gorm:"column:model;not null;default:''"`
+	PromptTokens     int64     `gorm:"column:prompt_tokens;not null;default:0"`
+	CompletionTokens int64     `gorm:"column:completion_tokens;not null;default:0"`
+	Source           string    `gorm:"column:source;not null;default:''"`       // upstream, local or cache
+	Tools            string    `gorm:"column:tools;not null;default:''"`        // names of the invoked tools
+	Redactions       int64     `gorm:"column:redactions;not null;default:0"`    // values redacted from the request
+	Cost             int64     `gorm:"column:cost;not null;default:0"`          // tokens deducted from the balance after pricing
+	Estimated        bool      `gorm:"column:estimated;not null;default:false"` // local counts estimated, the tokenizer was down or the model unknown
+	CreatedAt        time.Time `gorm:"column:created_at;index"`
+}
+
+func (UsageRecord) TableName() string {
+	return "usage_records"
+}
+
+// Price weights the tokens of a model against the balance
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// RecordUsage stores the usage of one completion and adds its cost to the user usage
+func (ac *AccountService) RecordUsage(record UsageRecord) error {
+	if err := ac.db.Create(&record).Error; err != nil {
+		return err
+	}
+	return ac.IncUsage(record.Username, record.Cost)
+}
+
+// recordUsage prices record with the current pricing and records it
+func (chat *ChatService) recordUsage(ctx context.Context, record UsageRecord) error {
+	record.Cost = record.PromptTokens + record.CompletionTokens
+	if price, ok := chat.params().Pricing[record.Model]; ok {
+		record.Cost = int64(math.Ceil(float64(record.PromptTokens)*price.Prompt + float64(record.CompletionTokens)*price.Completion))
+	}
+	return chat.account.WithContext(ctx).RecordUsage(record)
+}
+
+type UsageSummary struct {
+	Model            string
+	PromptTokens     int64
+	CompletionTokens int64
+	Requests         int64
+}
+
+// UsageSummary sums the usage records of a user since a time by model
+func (ac *AccountService) UsageSummary(username string, since time.Time) ([]UsageSummary, error) {
+	var summary []UsageSummary
+	result := ac.db.Model(&UsageRecord{}).
+		Select("model, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, count(*) as requests").
+		Where("username = ? AND created_at >= ?", username, since).
+		Group("model").Order("model").
+		Scan(&summary)
+	return summary, result.Error
+}
@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+)
+
+const (
+	VoucherMaxBatch = 1000
+	// without 0, O, 1 and I, which are easily mistaken when typed
+	voucherAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	voucherGroups   = 4
+	voucherGroupLen = 4
+)
+
+var voucherBatchPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// Voucher adds Amount tokens to the balance of the first user redeeming it before it expires
+type Voucher struct {
+	ID         int64      `gorm:"column:id;primaryKey;autoIncrement"`
+	Code       string     `gorm:"column:code;type:varchar(32);not null;unique"`
+	Batch      string     `gorm:"column:batch;type:varchar(32);not null;index"`
+	Amount     int64      `gorm:"column:amount;not null"`
+	ExpiresAt  *time.Time `gorm:"column:expires_at"` // nil never expires
+	RedeemedBy string     `gorm:"column:redeemed_by;not null;default:'';index"`
+	RedeemedAt *time.Time `gorm:"column:redeemed_at"`
+	CreatedAt  time.Time  `gorm:"column:created_at"`
+}
+
+func (Voucher) TableName() string {
+	return "vouchers"
+}
+
+// CreateVouchers generates number vouchers of amount tokens valid for days, 0 days never expires,
+// an empty batch gets a generated name
+func (ac *AccountService) CreateVouchers(batch string, number int, amount int64, days int) (string, []Voucher, error) {
+	if number <= 0 || number > VoucherMaxBatch {
+		return "", nil, apierror.Errorf(apierror.InvalidRequest, "voucher.number.invalid", VoucherMaxBatch)
+	}
+	if amount <= 0 {
+		return "", nil, apierror.Errorf(apierror.InvalidRequest, "voucher.amount.invalid")
+	}
+	if days < 0 {
+		return "", nil, apierror.Errorf(apierror.InvalidRequest, "invite.days.invalid")
+	}
+	if batch == "" {
+		bts := make([]byte, 3)
+		if _, err := rand.Read(bts); err != nil {
+			return "", nil, err
+		}
+		batch = time.Now().Format("20060102") + "-" + hex.EncodeToString(bts)
+	}
+	if !voucherBatchPattern.MatchString(batch) {
+		return "", nil, apierror.Errorf(apierror.InvalidRequest, "voucher.batch.invalid")
+	}
+	var expires *time.Time
+	if days > 0 {
+		at := time.Now().AddDate(0, 0, days)
+		expires = &at
+	}
+	vouchers := make([]Voucher, 0, number)
+	for i := 0; i < number; i++ {
+		code, err := voucherCode()
+		if err != nil {
+			return "", nil, err
+		}
+		vouchers = append(vouchers, Voucher{Code: code, Batch: batch, Amount: amount, ExpiresAt: expires})
+	}
+	if err := ac.db.CreateInBatches(vouchers, 100).Error; err != nil {
+		return "", nil, err
+	}
+	return batch, vouchers, nil
+}
+
+func voucherCode() (string, error) {
+	groups := make([]string, 0, voucherGroups)
+	for i := 0; i < voucherGroups; i++ {
+		group := make([]byte, voucherGroupLen)
+		for j := range group {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(voucherAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			group[j] = voucherAlphabet[n.Int64()]
+		}
+		groups = append(groups, string(group))
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeVoucher accepts a code typed in lower case or without the dashes
+func normalizeVoucher(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != voucherGroups*voucherGroupLen {
+		return code
+	}
+	groups := make([]string, 0, voucherGroups)
+	for i := 0; i < len(code); i += voucherGroupLen {
+		groups = append(groups, code[i:i+voucherGroupLen])
+	}
+	return strings.Join(groups, "-")
+}
+
+// Redeem marks the voucher redeemed by the user and adds its amount to the balance in one transaction
+func (ac *AccountService) Redeem(username, code string) (Voucher, error) {
+	var voucher Voucher
+	err := ac.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("code = ?", normalizeVoucher(code)).First(&voucher).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.Errorf(apierror.NotFound, "voucher.not.found")
+			}
+			return err
+		}
+		if voucher.RedeemedBy != "" {
+			return apierror.Errorf(apierror.Conflict, "voucher.redeemed")
+		}
+		if voucher.ExpiresAt != nil && time.Now().After(*voucher.ExpiresAt) {
+			return apierror.Errorf(apierror.InvalidRequest, "voucher.expired")
+		}
+		user, err := (&AccountService{db: tx}).CheckUser(username)
+		if err != nil {
+			return err
+		}
+		if user.Balance < 0 {
+			return apierror.Errorf(apierror.InvalidRequest, "voucher.unlimited")
+		}
+		now := time.Now()
+		result := tx.Model(&Voucher{}).Where("id = ? AND redeemed_by = ''", voucher.ID).
+			Updates(map[string]interface{}{"redeemed_by": username, "redeemed_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return apierror.Errorf(apierror.Conflict, "voucher.redeemed")
+		}
+		voucher.RedeemedBy, voucher.RedeemedAt = username, &now
+		return (&AccountService{db: tx}).IncBalance(username, voucher.Amount)
+	})
+	return voucher, err
+}
+
+type RedeemPayload struct {
+	Code string `json:"code"`
+}
+
+// RedeemProcess redeems a voucher for the authenticated user and returns the new balance
+func (ac *AccountService) RedeemProcess(ctx *gin.Context) {
+	ac = ac.WithContext(ctx)
+	payload := RedeemPayload{}
+	if err := ctx.BindJSON(&payload); err != nil {
+		klog.FromContext(ctx).Error(err, "RedeemProcess error")
+		apierror.Fail(ctx, apierror.New(apierror.InvalidRequest, err))
+		return
+	}
+	username := ctx.GetString("username")
+	voucher, err := ac.Redeem(username, payload.Code)
+	if err != nil {
+		klog.FromContext(ctx).Info("redeem failed", "username", username, "err", err)
+		apierror.Fail(ctx, accountError(err))
+		return
+	}
+	klog.FromContext(ctx).Info("voucher redeemed", "username", username, "batch", voucher.Batch, "amount", voucher.Amount)
+	user, err := ac.CheckUser(username)
+	if err != nil {
+		apierror.Fail(ctx, accountError(err))
+		return
+	}
+	allowance, err := ac.AllowanceOf(user)
+	if err != nil {
+		apierror.Fail(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  "Success",
+		"message": "success",
+		"data": gin.H{
+			"amount":  voucher.Amount,
+			"balance": allowance.Remaining(),
+		},
+	})
+}
+
+// VoucherExport serves the vouchers of a batch as csv
+func (ac *AccountService) VoucherExport(ctx *gin.Context) {
+	ac = ac.WithContext(ctx)
+	batch := ctx.Query("batch")
+	if !voucherBatchPattern.MatchString(batch) {
+		apierror.Fail(ctx, apierror.Errorf(apierror.InvalidRequest, "voucher.batch.invalid"))
+		return
+	}
+	var vouchers []Voucher
+	if err := ac.db.Where("batch = ?", batch).Order("id").Find(&vouchers).Error; err != nil {
+		apierror.Fail(ctx, err)
+		return
+	}
+	if len(vouchers) == 0 {
+		apierror.Fail(ctx, apierror.Errorf(apierror.NotFound, "voucher.batch.not.found"))
+		return
+	}
+	buf := bytes.Buffer{}
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"code", "amount", "expires_at", "redeemed_by", "redeemed_at", "created_at"})
+	for _, voucher := range vouchers {
+		writer.Write([]string{
+			voucher.Code,
+			strconv.FormatInt(voucher.Amount, 10),
+			formatTime(voucher.ExpiresAt),
+			voucher.RedeemedBy,
+			formatTime(voucher.RedeemedAt),
+			voucher.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	writer.Flush()
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=vouchers-%s.csv", batch))
+	ctx.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+func formatTime(at *time.Time) string {
+	if at == nil {
+		return ""
+	}
+	return at.Format(time.RFC3339)
+}
@@ -0,0 +1,23 @@
+package controllers
+
+import "testing"
+
+func TestNormalizeVoucher(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"ABCD-EFGH-JKLM-NPQR", "ABCD-EFGH-JKLM-NPQR"},
+		{"abcd-efgh-jklm-npqr", "ABCD-EFGH-JKLM-NPQR"},
+		{"abcdefghjklmnpqr", "ABCD-EFGH-JKLM-NPQR"},
+		{" abcd efgh jklm npqr ", "ABCD-EFGH-JKLM-NPQR"},
+		{"ab-cdefgh-jklmnp-qr", "ABCD-EFGH-JKLM-NPQR"},
+		{"abc-def", "ABCDEF"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeVoucher(tt.code); got != tt.want {
+			t.Errorf("normalizeVoucher(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package i18n
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ZhCN = "zh-CN"
+	En   = "en"
+)
+
+var (
+	Default = ZhCN
+
+	lock     sync.RWMutex
+	catalogs = map[string]map[string]string{
+		ZhCN: {},
+		En:   {},
+	}
+)
+
+// Register adds messages of a locale to the catalog, later keys override earlier ones
+func Register(locale string, messages map[string]string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := catalogs[locale]; !ok {
+		catalogs[locale] = map[string]string{}
+	}
+	for key, message := range messages {
+		catalogs[locale][key] = message
+	}
+}
+
+// T formats the message of key in locale, falling back to the default locale and then the key itself
+func T(locale, key string, args ...interface{}) string {
+	lock.RLock()
+	message, ok := catalogs[locale][key]
+	if !ok {
+		message, ok = catalogs[Default][key]
+	}
+	lock.RUnlock()
+	if !ok {
+		message = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// Supported returns the catalog locale matching tag such as zh, zh-TW or en-US, or empty
+func Supported(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	lock.RLock()
+	defer lock.RUnlock()
+	for locale := range catalogs {
+		if strings.ToLower(locale) == tag {
+			return locale
+		}
+	}
+	for locale := range catalogs {
+		if strings.SplitN(strings.ToLower(locale), "-", 2)[0] == strings.SplitN(tag, "-", 2)[0] {
+			return locale
+		}
+	}
+	return ""
+}
+
+// Locale picks the first supported language of an Accept-Language header
+func Locale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.SplitN(part, ";", 2)[0]
+		if locale := Supported(tag); locale != "" {
+			return locale
+		}
+	}
+	return Default
+}
+
+// Preferred returns the preference when it is a supported locale, otherwise the Accept-Language choice
+func Preferred(preference, acceptLanguage string) string {
+	if preference != "" {
+		if locale := Supported(preference); locale != "" {
+			return locale
+		}
+	}
+	return Locale(acceptLanguage)
+}
+
+// Lang is the locale of a request, set by the auth middleware or taken from Accept-Language
+func Lang(c *gin.Context) string {
+	if locale := c.GetString("locale"); locale != "" {
+		return locale
+	}
+	return Locale(c.Request.Header.Get("Accept-Language"))
+}
+
+// Error is an error with a catalog message, Error returns the message in the default locale
+type Error struct {
+	Key  string
+	Args []interface{}
+}
+
+func Errorf(key string, args ...interface{}) error {
+	return &Error{Key: key, Args: args}
+}
+
+func (e *Error) Error() string {
+	return T(Default, e.Key, e.Args...)
+}
+
+// Message translates err when it is an Error and returns its text otherwise
+func Message(locale string, err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = arg
+			if inner, ok := arg.(error); ok {
+				args[i] = Message(locale, inner)
+			}
+		}
+		return T(locale, e.Key, args...)
+	}
+	return fmt.Sprintf("%v", err)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-logr/logr/funcr"
+	"k8s.io/klog/v2"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	RequestIDHeader = "X-Request-Id"
+)
+
+// Setup switches klog to one JSON object per line with format json, text keeps the klog format
+func Setup(format string) error {
+	switch format {
+	case "", FormatText:
+		return nil
+	case FormatJSON:
+		logger := funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{
+			LogTimestamp:    true,
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+		})
+		klog.SetLoggerWithOptions(logger.WithName("chatgpt-web"), klog.ContextualLogger(true))
+		return nil
+	}
+	return fmt.Errorf("unsupported log format %s, use text or json", format)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID stores the request id in ctx and adds it to the logger of ctx
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx), "request_id", id))
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Detach returns a context that keeps the request id of ctx but not its cancellation,
+// for work that outlives the request
+func Detach(ctx context.Context) context.Context {
+	if id := RequestID(ctx); id != "" {
+		return WithRequestID(context.Background(), id)
+	}
+	return context.Background()
+}
+
+// Transport sends the request id of the request context to the upstream
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := RequestID(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(RequestIDHeader, id)
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
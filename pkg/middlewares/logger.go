@@ -0,0 +1,30 @@
+package middlewares
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// Logger writes one structured line per request, the username, model and error code
+// are added when the handlers set them
+func Logger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		kv := []interface{}{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		for _, key := range []string{"username", "model", "error_code"} {
+			if value := c.GetString(key); value != "" {
+				kv = append(kv, key, value)
+			}
+		}
+		klog.FromContext(c.Request.Context()).Info("request", kv...)
+	}
+}
@@ -0,0 +1,14 @@
+package middlewares
+
+import (
+	"github.com/Arvintian/chatgpt-web/pkg/i18n"
+)
+
+func init() {
+	i18n.Register(i18n.ZhCN, map[string]string{
+		"rate.limited": "请求过于频繁,请稍后再试",
+	})
+	i18n.Register(i18n.En, map[string]string{
+		"rate.limited": "Too many requests, please try again later",
+	})
+}
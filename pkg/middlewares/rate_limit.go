@@ -1,21 +1,74 @@
 package middlewares
 
 import (
+	"sync"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/apierror"
 	"github.com/gin-gonic/gin"
+	ccache "github.com/karlseguin/ccache/v3"
 	"golang.org/x/time/rate"
 )
 
+const IPLimiterTTL = time.Hour // an idle client ip starts over with a full burst
+
 func RateLimitMiddleware(r rate.Limit, b int) gin.HandlerFunc {
-	limiter := rate.NewLimiter(r, b)
+	return RateLimiterMiddleware(rate.NewLimiter(r, b))
+}
+
+// RateLimiterMiddleware limits with a shared limiter, its rate may be changed while serving
+func RateLimiterMiddleware(limiter *rate.Limiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if !limiter.Allow() {
 			// 请求被限制，返回错误信息
-			c.JSON(429, gin.H{
-				"status":  "Fail",
-				"message": "Too many requests, please try again later",
-				"data":    nil,
-			})
-			c.Abort()
+			apierror.Abort(c, apierror.Errorf(apierror.RateLimited, "rate.limited"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// IPRateLimiter keeps a limiter per client ip
+type IPRateLimiter struct {
+	lock     sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters *ccache.Cache[*rate.Limiter]
+}
+
+func NewIPRateLimiter(r rate.Limit, b int) *IPRateLimiter {
+	return &IPRateLimiter{
+		limit:    r,
+		burst:    b,
+		limiters: ccache.New(ccache.Configure[*rate.Limiter]()),
+	}
+}
+
+// SetLimit changes the rate of every client ip
+func (l *IPRateLimiter) SetLimit(r rate.Limit, b int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit, l.burst = r, b
+	l.limiters.Clear()
+}
+
+func (l *IPRateLimiter) get(ip string) *rate.Limiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if item := l.limiters.Get(ip); item != nil && !item.Expired() {
+		item.Extend(IPLimiterTTL)
+		return item.Value()
+	}
+	limiter := rate.NewLimiter(l.limit, l.burst)
+	l.limiters.Set(ip, limiter, IPLimiterTTL)
+	return limiter
+}
+
+// Middleware limits the requests of each client ip
+func (l *IPRateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.get(c.ClientIP()).Allow() {
+			apierror.Abort(c, apierror.Errorf(apierror.RateLimited, "rate.limited"))
 			return
 		}
 		c.Next()
@@ -0,0 +1,26 @@
+package middlewares
+
+import (
+	"regexp"
+
+	"github.com/Arvintian/chatgpt-web/pkg/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// RequestID takes the X-Request-Id of the client or generates one, puts it in the
+// request context for logs and upstream calls and echoes it in the response
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(logging.RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.New().String()
+		}
+		c.Set("request_id", id)
+		c.Header(logging.RequestIDHeader, id)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+// Tracing starts the server span of a request, continuing the trace of an incoming traceparent,
+// the username, model and error code are added when the handlers set them
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name = fmt.Sprintf("%s %s", c.Request.Method, route)
+		}
+		ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+		ctx, span := tracing.Start(ctx, name,
+			semconv.HTTPMethodKey.String(c.Request.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.HTTPTargetKey.String(c.Request.URL.Path),
+			semconv.NetPeerIPKey.String(c.ClientIP()),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		for _, key := range []string{"request_id", "username", "model", "error_code"} {
+			if value := c.GetString(key); value != "" {
+				span.SetAttributes(attribute.String(key, value))
+			}
+		}
+		// the legacy envelope answers failures with 200, the error code tells them
+		if code := c.GetString("error_code"); code != "" {
+			span.SetStatus(codes.Error, code)
+		} else if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
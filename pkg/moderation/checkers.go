@@ -0,0 +1,120 @@
+package moderation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Keywords flags texts containing a keyword of the list, case insensitive, or matching a pattern
+type Keywords struct {
+	words    []string
+	patterns []*regexp.Regexp
+}
+
+// LoadKeywords reads a list with one keyword per line, lines starting with re: are regular
+// expressions and lines starting with # are comments
+func LoadKeywords(path string) (*Keywords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keywords := &Keywords{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "re:") {
+			pattern, err := regexp.Compile(strings.TrimPrefix(line, "re:"))
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, n, err)
+			}
+			keywords.patterns = append(keywords.patterns, pattern)
+			continue
+		}
+		keywords.words = append(keywords.words, strings.ToLower(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keywords, nil
+}
+
+func (k *Keywords) Name() string {
+	return "keywords"
+}
+
+func (k *Keywords) Check(ctx context.Context, text string) ([]string, error) {
+	categories := []string{}
+	lower := strings.ToLower(text)
+	for _, word := range k.words {
+		if strings.Contains(lower, word) {
+			categories = append(categories, "keyword:"+word)
+		}
+	}
+	for _, pattern := range k.patterns {
+		if pattern.MatchString(text) {
+			categories = append(categories, "re:"+pattern.String())
+		}
+	}
+	return categories, nil
+}
+
+// OpenAI flags texts through the moderation endpoint of an OpenAI compatible api
+type OpenAI struct {
+	client *openai.Client
+	model  string
+}
+
+func NewOpenAI(client *openai.Client, model string) *OpenAI {
+	return &OpenAI{client: client, model: model}
+}
+
+func (o *OpenAI) Name() string {
+	return "openai"
+}
+
+func (o *OpenAI) Check(ctx context.Context, text string) ([]string, error) {
+	rsp, err := o.client.Moderations(ctx, openai.ModerationRequest{
+		Input: text,
+		Model: o.model,
+	})
+	if err != nil {
+		return nil, err
+	}
+	categories := []string{}
+	for _, result := range rsp.Results {
+		if !result.Flagged {
+			continue
+		}
+		// the categories are a struct of bools, their json names are the category names
+		bts, err := json.Marshal(result.Categories)
+		if err != nil {
+			return nil, err
+		}
+		flagged := map[string]bool{}
+		if err := json.Unmarshal(bts, &flagged); err != nil {
+			return nil, err
+		}
+		for category, ok := range flagged {
+			if ok {
+				categories = append(categories, category)
+			}
+		}
+		if len(categories) == 0 {
+			categories = append(categories, "flagged")
+		}
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
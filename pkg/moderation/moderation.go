@@ -0,0 +1,152 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
+)
+
+// Action is what a flag of a checker does to the chat
+type Action string
+
+const (
+	Block Action = "block" // stop the prompt or the completion
+	Warn  Action = "warn"  // go on with a notice to the user
+	Log   Action = "log"   // go on silently, only the event is recorded
+)
+
+// Stage is the text a checker is applied to
+type Stage string
+
+const (
+	Prompt     Stage = "prompt"
+	Completion Stage = "completion"
+)
+
+// Checker inspects a text and returns the categories it flags, none when the text passes
+type Checker interface {
+	Name() string
+	Check(ctx context.Context, text string) ([]string, error)
+}
+
+type Rule struct {
+	Checker Checker
+	Action  Action
+	Stages  []Stage
+}
+
+func (r Rule) applies(stage Stage) bool {
+	for _, s := range r.Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+type Flag struct {
+	Checker    string
+	Action     Action
+	Stage      Stage
+	Categories []string
+}
+
+type Pipeline struct {
+	rules []Rule
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+func (p *Pipeline) Add(rule Rule) {
+	p.rules = append(p.rules, rule)
+}
+
+// Has reports whether any checker is applied to stage
+func (p *Pipeline) Has(stage Stage) bool {
+	for _, rule := range p.rules {
+		if rule.applies(stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check runs the checkers of stage on text in order. A failing checker is logged and skipped,
+// an outage of the moderation endpoint does not stop the chats.
+func (p *Pipeline) Check(ctx context.Context, stage Stage, text string) []Flag {
+	flags := []Flag{}
+	if strings.TrimSpace(text) == "" {
+		return flags
+	}
+	ctx, span := tracing.Start(ctx, "moderation.check", attribute.String("stage", string(stage)))
+	defer func() {
+		span.SetAttributes(attribute.Int("flags", len(flags)))
+		span.End()
+	}()
+	for _, rule := range p.rules {
+		if !rule.applies(stage) {
+			continue
+		}
+		categories, err := rule.Checker.Check(ctx, text)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "moderation check error", "checker", rule.Checker.Name(), "stage", stage)
+			continue
+		}
+		if len(categories) > 0 {
+			flags = append(flags, Flag{
+				Checker:    rule.Checker.Name(),
+				Action:     rule.Action,
+				Stage:      stage,
+				Categories: categories,
+			})
+		}
+	}
+	return flags
+}
+
+// Strongest returns the most severe action of flags, empty without flags
+func Strongest(flags []Flag) Action {
+	action := Action("")
+	for _, flag := range flags {
+		switch {
+		case flag.Action == Block:
+			return Block
+		case flag.Action == Warn:
+			action = Warn
+		case action == "":
+			action = flag.Action
+		}
+	}
+	return action
+}
+
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case Block, Warn, Log:
+		return Action(s), nil
+	}
+	return "", fmt.Errorf("unknown moderation action %s, use block, warn or log", s)
+}
+
+// ParseStages parses stage names, empty items are skipped
+func ParseStages(items []string) ([]Stage, error) {
+	stages := []Stage{}
+	for _, item := range items {
+		switch Stage(strings.TrimSpace(item)) {
+		case "":
+		case Prompt:
+			stages = append(stages, Prompt)
+		case Completion:
+			stages = append(stages, Completion)
+		default:
+			return nil, fmt.Errorf("unknown moderation stage %s, use prompt or completion", item)
+		}
+	}
+	return stages, nil
+}
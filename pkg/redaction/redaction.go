@@ -0,0 +1,245 @@
+package redaction
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type pattern struct {
+	name   string
+	regexp *regexp.Regexp
+	check  func(match string) bool // rejects false positives of the regexp
+}
+
+// builtin patterns, the more specific ones first so a card number is not taken for a phone number
+var builtin = []pattern{
+	{name: "openai_key", regexp: regexp.MustCompile(`\bsk-(?:proj-|svcacct-|admin-)?[A-Za-z0-9_-]{20,}`)},
+	{name: "aws_key", regexp: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "aws_key", regexp: regexp.MustCompile(`(?i)aws_?secret_?access_?key["'\s:=]+[A-Za-z0-9/+]{40}`)},
+	{name: "email", regexp: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{name: "credit_card", regexp: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), check: luhn},
+	// a phone number has a country code or separated groups, a bare run of digits is more often an id or a timestamp
+	{name: "phone", regexp: regexp.MustCompile(`\+\d{1,3}[ -]?\d{3,4}[ -]?\d{3,4}[ -]?\d{3,4}\b|\b\d{3,4}[ -]\d{3,4}[ -]\d{3,4}\b`)},
+}
+
+var (
+	namePattern        = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	placeholderPattern = regexp.MustCompile(`\[[A-Z0-9_]+_[0-9a-f]{6}\]`)
+)
+
+// Redactor replaces sensitive values with placeholders, the same value always gets the same
+// placeholder during the life of the process so the model sees consistent conversations
+type Redactor struct {
+	patterns []pattern
+	salt     []byte
+}
+
+// New enables the builtin patterns by name: email, phone, credit_card, aws_key and openai_key,
+// custom is a file with one NAME=regexp per line, lines starting with # are comments
+func New(names []string, custom string) (*Redactor, error) {
+	r := &Redactor{salt: make([]byte, 16)}
+	if _, err := rand.Read(r.salt); err != nil {
+		return nil, err
+	}
+	enabled := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, p := range builtin {
+			found = found || p.name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown redaction pattern %s, use email, phone, credit_card, aws_key or openai_key", name)
+		}
+		enabled[name] = true
+	}
+	if custom != "" {
+		patterns, err := loadPatterns(custom)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, patterns...)
+	}
+	for _, p := range builtin {
+		if enabled[p.name] {
+			r.patterns = append(r.patterns, p)
+		}
+	}
+	return r, nil
+}
+
+func loadPatterns(path string) ([]pattern, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	patterns := []pattern{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, expr, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !namePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s line %d: want NAME=regexp, the name made of letters, digits and _", path, n)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, n, err)
+		}
+		patterns = append(patterns, pattern{name: strings.ToLower(name), regexp: re})
+	}
+	return patterns, scanner.Err()
+}
+
+func (r *Redactor) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.patterns)
+}
+
+// Redact replaces the matches in text and remembers them in m for Restore, the placeholders
+// inserted by a pattern are left alone by the next ones
+func (r *Redactor) Redact(text string, m *Mapping) string {
+	if r.Len() == 0 || text == "" {
+		return text
+	}
+	for _, p := range r.patterns {
+		text = outsidePlaceholders(text, func(segment string) string {
+			return p.regexp.ReplaceAllStringFunc(segment, func(match string) string {
+				if p.check != nil && !p.check(match) {
+					return match
+				}
+				placeholder := r.placeholder(p.name, match)
+				m.add(placeholder, match)
+				return placeholder
+			})
+		})
+	}
+	return text
+}
+
+// outsidePlaceholders applies replace to the parts of text between the placeholders
+func outsidePlaceholders(text string, replace func(string) string) string {
+	locations := placeholderPattern.FindAllStringIndex(text, -1)
+	if len(locations) == 0 {
+		return replace(text)
+	}
+	var b strings.Builder
+	last := 0
+	for _, location := range locations {
+		b.WriteString(replace(text[last:location[0]]))
+		b.WriteString(text[location[0]:location[1]])
+		last = location[1]
+	}
+	b.WriteString(replace(text[last:]))
+	return b.String()
+}
+
+func (r *Redactor) placeholder(name, value string) string {
+	hash := sha256.New()
+	hash.Write(r.salt)
+	hash.Write([]byte(value))
+	return fmt.Sprintf("[%s_%s]", strings.ToUpper(name), hex.EncodeToString(hash.Sum(nil))[:6])
+}
+
+// Mapping holds the values redacted from the messages of one request
+type Mapping struct {
+	values  map[string]string
+	longest int
+	Count   int // replaced occurrences
+}
+
+func NewMapping() *Mapping {
+	return &Mapping{values: map[string]string{}}
+}
+
+func (m *Mapping) add(placeholder, value string) {
+	m.values[placeholder] = value
+	if len(placeholder) > m.longest {
+		m.longest = len(placeholder)
+	}
+	m.Count++
+}
+
+// Restore puts the original values back for the placeholders of m, others are kept
+func (m *Mapping) Restore(text string) string {
+	if len(m.values) == 0 {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		if value, ok := m.values[placeholder]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// Restorer restores a text streamed in deltas, where a placeholder may be cut between two of them,
+// a nil Restorer passes the text through
+type Restorer struct {
+	mapping *Mapping
+	pending string
+}
+
+func NewRestorer(m *Mapping) *Restorer {
+	return &Restorer{mapping: m}
+}
+
+// Write returns the restored text of delta, an unfinished placeholder at the end is held back
+func (r *Restorer) Write(delta string) string {
+	if r == nil {
+		return delta
+	}
+	text := r.pending + delta
+	r.pending = ""
+	if i := strings.LastIndex(text, "["); i >= 0 && !strings.Contains(text[i:], "]") && len(text)-i < r.mapping.longest {
+		text, r.pending = text[:i], text[i:]
+	}
+	return r.mapping.Restore(text)
+}
+
+// Flush returns the text held back
+func (r *Restorer) Flush() string {
+	if r == nil {
+		return ""
+	}
+	text := r.pending
+	r.pending = ""
+	return r.mapping.Restore(text)
+}
+
+// luhn checks the digits of a card number
+func luhn(number string) bool {
+	sum, double, digits := 0, false, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
@@ -0,0 +1,123 @@
+package redaction
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactPhone(t *testing.T) {
+	r, err := New([]string{"phone"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text     string
+		redacted bool
+	}{
+		{"call +86 138 0013 8000", true},
+		{"call +8613800138000", true},
+		{"call 138-0013-8000", true},
+		{"call 138 0013 8000", true},
+		{"order 13800138000", false},
+		{"timestamp 1697712000", false},
+		{"id 202310191234", false},
+	}
+	for _, tt := range tests {
+		m := NewMapping()
+		got := r.Redact(tt.text, m)
+		if redacted := m.Count > 0; redacted != tt.redacted {
+			t.Errorf("Redact(%q) = %q, redacted %v, want %v", tt.text, got, redacted, tt.redacted)
+		}
+		if restored := m.Restore(got); restored != tt.text {
+			t.Errorf("Restore(%q) = %q, want %q", got, restored, tt.text)
+		}
+	}
+}
+
+func TestRedactSkipsPlaceholders(t *testing.T) {
+	custom := filepath.Join(t.TempDir(), "patterns")
+	if err := os.WriteFile(custom, []byte("# the hash of a placeholder is a hex id too\nWORD=secret\nHEX=[0-9a-f]{6}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(nil, custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMapping()
+	text := "the secret of abcdef"
+	got := r.Redact(text, m)
+	if m.Count != 2 {
+		t.Errorf("Redact(%q) = %q, replaced %d, want 2", text, got, m.Count)
+	}
+	if !strings.Contains(got, "[WORD_") {
+		t.Errorf("Redact(%q) = %q, want the word placeholder kept", text, got)
+	}
+	if restored := m.Restore(got); restored != text {
+		t.Errorf("Restore(%q) = %q, want %q", got, restored, text)
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4111 1111 1111 1111", true},
+		{"4242-4242-4242-4242", true},
+		{"378282246310005", true},
+		{"4111111111111112", false},
+		{"79927398713", false}, // valid checksum, too short for a card
+		{"0000 0000 0000 0000 0000", false},
+	}
+	for _, tt := range tests {
+		if got := luhn(tt.number); got != tt.want {
+			t.Errorf("luhn(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestRestorer(t *testing.T) {
+	r, err := New([]string{"email"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMapping()
+	text := "mail bob@example.com [soon]"
+	redacted := r.Redact(text, m)
+	start := strings.Index(redacted, "[EMAIL_")
+	tests := []struct {
+		name   string
+		splits []int // offsets in the redacted text where a delta ends
+	}{
+		{"whole", nil},
+		{"before the placeholder", []int{start}},
+		{"after the bracket", []int{start + 1}},
+		{"inside the hash", []int{start + 10}},
+		{"before the closing bracket", []int{start + len("[EMAIL_abcdef")}},
+		{"every byte", func() []int {
+			splits := []int{}
+			for i := 1; i < len(redacted); i++ {
+				splits = append(splits, i)
+			}
+			return splits
+		}()},
+	}
+	for _, tt := range tests {
+		restorer := NewRestorer(m)
+		got, last := "", 0
+		for _, split := range tt.splits {
+			got += restorer.Write(redacted[last:split])
+			last = split
+		}
+		got += restorer.Write(redacted[last:]) + restorer.Flush()
+		if got != text {
+			t.Errorf("%s: restored %q, want %q", tt.name, got, text)
+		}
+	}
+	var restorer *Restorer
+	if got := restorer.Write(redacted) + restorer.Flush(); got != redacted {
+		t.Errorf("nil Restorer = %q, want %q", got, redacted)
+	}
+}
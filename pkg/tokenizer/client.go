@@ -0,0 +1,227 @@
+package tokenizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Arvintian/chatgpt-web/pkg/tracing"
+	ccache "github.com/karlseguin/ccache/v3"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
+)
+
+const (
+	RequestTimeout = 10 * time.Second
+	DialTimeout    = time.Second
+	IdleConns      = 32
+	IdleTimeout    = 90 * time.Second
+	BatchSize      = 256 // messages of a batch request
+	CacheSize      = 10000
+	CacheTTL       = time.Hour
+)
+
+// Client counts the tokens with the tokenizer process over keep-alive connections, the counts
+// are kept in an LRU cache by the model and the content hash of the message
+type Client struct {
+	endpoint string
+	http     *http.Client
+	cache    *ccache.Cache[cachedCount]
+	unknown  sync.Map // models counted with the default encoding
+}
+
+type cachedCount struct {
+	tokens    int
+	estimated bool
+}
+
+type tokenInfo struct {
+	Code      int    `json:"code"`
+	Count     int    `json:"num_tokens"`
+	Estimated bool   `json:"estimated"` // counted with the default encoding of an unknown model
+	Msg       string `json:"msg"`
+}
+
+type batchRequest struct {
+	Messages []openai.ChatCompletionMessage `json:"messages"`
+}
+
+type batchInfo struct {
+	Code      int    `json:"code"`
+	Counts    []int  `json:"counts"`
+	Estimated bool   `json:"estimated"`
+	Msg       string `json:"msg"`
+}
+
+// NewClient returns a client of the tokenizer process listening on port
+func NewClient(port int) *Client {
+	return &Client{
+		endpoint: fmt.Sprintf("http://127.0.0.1:%d", port),
+		http: &http.Client{
+			Timeout: RequestTimeout,
+			Transport: &http.Transport{
+				DialContext:         (&net.Dialer{Timeout: DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConns:        IdleConns,
+				MaxIdleConnsPerHost: IdleConns,
+				IdleConnTimeout:     IdleTimeout,
+				DisableCompression:  true,
+			},
+		},
+		cache: ccache.New(ccache.Configure[cachedCount]().MaxSize(CacheSize)),
+	}
+}
+
+// Count counts the tokens of message, while the process is down the count is estimated from the characters,
+// estimated is also set for the default encoding of an unknown model
+func (c *Client) Count(ctx context.Context, message openai.ChatCompletionMessage, model string) (count int, estimated bool, err error) {
+	ctx, span := tracing.Start(ctx, "tokenizer.count", attribute.String("model", model))
+	cached := false
+	defer func() {
+		span.SetAttributes(attribute.Int("tokens", count), attribute.Bool("estimated", estimated), attribute.Bool("cached", cached))
+		tracing.End(span, err)
+	}()
+	key := cacheKey(message, model)
+	if item := c.cache.Get(key); item != nil && !item.Expired() {
+		cached = true
+		return item.Value().tokens, item.Value().estimated, nil
+	}
+	if down.Load() {
+		return Estimate(message), true, nil
+	}
+	info := tokenInfo{}
+	if err := c.postJSON(ctx, c.countURL(model, ""), &message, &info); err != nil {
+		if ctx.Err() != nil {
+			return 0, false, err
+		}
+		klog.FromContext(ctx).Error(err, "tokenizer unavailable, estimate the tokens")
+		return Estimate(message), true, nil
+	}
+	if info.Code != 200 {
+		return 0, false, fmt.Errorf("%v", info.Msg)
+	}
+	if info.Estimated {
+		c.unknownModel(ctx, model)
+	}
+	c.cache.Set(key, cachedCount{tokens: info.Count, estimated: info.Estimated}, CacheTTL)
+	return info.Count, info.Estimated, nil
+}
+
+// CountBatch counts the tokens of each of messages, the ones not cached are sent in batches of BatchSize,
+// estimated is set when any of the counts is
+func (c *Client) CountBatch(ctx context.Context, messages []openai.ChatCompletionMessage, model string) (counts []int, estimated bool, err error) {
+	ctx, span := tracing.Start(ctx, "tokenizer.count_batch", attribute.String("model", model), attribute.Int("messages", len(messages)))
+	cached := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("cached", cached), attribute.Bool("estimated", estimated))
+		tracing.End(span, err)
+	}()
+	counts = make([]int, len(messages))
+	keys := make([]string, len(messages))
+	missing := []int{}
+	for i, message := range messages {
+		keys[i] = cacheKey(message, model)
+		if item := c.cache.Get(keys[i]); item != nil && !item.Expired() {
+			counts[i] = item.Value().tokens
+			estimated = estimated || item.Value().estimated
+			cached++
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	for start := 0; start < len(missing); start += BatchSize {
+		end := start + BatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch := batchRequest{Messages: make([]openai.ChatCompletionMessage, 0, end-start)}
+		for _, i := range missing[start:end] {
+			batch.Messages = append(batch.Messages, messages[i])
+		}
+		info := batchInfo{}
+		if down.Load() {
+			estimated = true
+		} else if err := c.postJSON(ctx, c.countURL(model, "/batch"), &batch, &info); err != nil {
+			if ctx.Err() != nil {
+				return nil, false, err
+			}
+			klog.FromContext(ctx).Error(err, "tokenizer unavailable, estimate the tokens")
+			estimated = true
+		} else if info.Code != 200 {
+			return nil, false, fmt.Errorf("%v", info.Msg)
+		} else if len(info.Counts) != len(batch.Messages) {
+			return nil, false, fmt.Errorf("tokenizer returned %d counts of %d messages", len(info.Counts), len(batch.Messages))
+		} else if info.Estimated {
+			estimated = true
+			c.unknownModel(ctx, model)
+		}
+		for j, i := range missing[start:end] {
+			if info.Counts == nil {
+				counts[i] = Estimate(messages[i])
+				continue
+			}
+			counts[i] = info.Counts[j]
+			c.cache.Set(keys[i], cachedCount{tokens: counts[i], estimated: info.Estimated}, CacheTTL)
+		}
+	}
+	return counts, estimated, nil
+}
+
+// unknownModel warns once about a model without an encoding
+func (c *Client) unknownModel(ctx context.Context, model string) {
+	if _, warned := c.unknown.LoadOrStore(model, true); !warned {
+		klog.FromContext(ctx).Info("model without an encoding, tokens estimated with the default encoding", "model", model)
+	}
+}
+
+// ping checks the process with an uncached count
+func (c *Client) ping(ctx context.Context) error {
+	info := tokenInfo{}
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "ping"}
+	if err := c.postJSON(ctx, c.countURL(openai.GPT3Dot5Turbo, ""), &message, &info); err != nil {
+		return err
+	}
+	if info.Code != 200 {
+		return fmt.Errorf("%v", info.Msg)
+	}
+	return nil
+}
+
+// countURL keeps the path readable for a model name with a slash such as Qwen/Qwen2.5-7B-Instruct,
+// the process matches the encodings against the name of the query
+func (c *Client) countURL(model, suffix string) string {
+	return fmt.Sprintf("%s/tokenizer/%s%s?model=%s", c.endpoint, url.PathEscape(strings.ReplaceAll(model, "/", "-")), suffix, url.QueryEscape(model))
+}
+
+func (c *Client) postJSON(ctx context.Context, url string, requestData interface{}, responseData interface{}) error {
+	requestBody, err := json.Marshal(requestData)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(responseData)
+}
+
+func cacheKey(message openai.ChatCompletionMessage, model string) string {
+	sum := sha256.Sum256([]byte(message.Role + "\x00" + message.Name + "\x00" + message.Content))
+	return fmt.Sprintf("%s:%x", model, sum)
+}
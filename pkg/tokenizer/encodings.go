@@ -0,0 +1,49 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Encodings maps models to tiktoken encodings for tokenizer.py, the patterns may end with * and
+// the longest match wins, unmatched models are counted with Default and marked estimated
+type Encodings struct {
+	Default string              `json:"default"`
+	Models  map[string]Encoding `json:"models"`
+}
+
+// Encoding is the encoding and the overheads of the messages of a model, the overheads
+// default to 3 per message, 1 per name and 3 per reply
+type Encoding struct {
+	Encoding         string `json:"encoding"`
+	TokensPerMessage *int   `json:"tokens_per_message"`
+	TokensPerName    *int   `json:"tokens_per_name"`
+	TokensPerReply   *int   `json:"tokens_per_reply"`
+}
+
+// ReadEncodings reads and checks an encodings json file
+func ReadEncodings(path string) (*Encodings, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	encodings := &Encodings{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(encodings); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for model, encoding := range encodings.Models {
+		if model == "" {
+			return nil, fmt.Errorf("%s: empty model pattern", path)
+		}
+		for name, tokens := range map[string]*int{"tokens_per_message": encoding.TokensPerMessage, "tokens_per_reply": encoding.TokensPerReply} {
+			if tokens != nil && *tokens < 0 {
+				return nil, fmt.Errorf("%s: %s of %s must not be negative", path, name, model)
+			}
+		}
+	}
+	return encodings, nil
+}
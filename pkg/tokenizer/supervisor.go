@@ -0,0 +1,143 @@
+package tokenizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	RestartMinBackoff = time.Second
+	RestartMaxBackoff = time.Minute
+	StableRun         = time.Minute // a run this long resets the backoff
+	StartTimeout      = 30 * time.Second
+	HealthInterval    = 5 * time.Second
+	HealthTimeout     = 2 * time.Second
+	HealthFailures    = 3 // consecutive failed checks before a restart
+	StopTimeout       = 5 * time.Second
+)
+
+// Supervisor runs the tokenizer process, restarts it with backoff when it exits or fails its
+// health checks, and marks it down meanwhile so the counts are estimated
+type Supervisor struct {
+	Module    string
+	Port      int
+	Workers   int
+	Encodings string // json file of the model encodings, see Encodings
+}
+
+// Run supervises the process until ctx is done, then interrupts it
+func (s *Supervisor) Run(ctx context.Context) {
+	// estimated until the first health check passes
+	down.Store(true)
+	backoff := RestartMinBackoff
+	for {
+		started := time.Now()
+		err := s.run(ctx)
+		setDown(true)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > StableRun {
+			backoff = RestartMinBackoff
+		}
+		klog.ErrorS(err, "tokenizer stopped, restart", "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > RestartMaxBackoff {
+			backoff = RestartMaxBackoff
+		}
+	}
+}
+
+// run starts the process and checks it until it exits, turns unhealthy or ctx is done
+func (s *Supervisor) run(ctx context.Context) error {
+	cmd := exec.Command("nuxt", "--module", s.Module, "--workers", strconv.Itoa(s.Workers), "--port", strconv.Itoa(s.Port))
+	cmd.Env = append(os.Environ(), "TOKENIZER_ENCODINGS="+s.Encodings)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	klog.Infof("Start Tokenizer with %v", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	client := NewClient(s.Port)
+	started, ready, failures := time.Now(), false, 0
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("tokenizer exited")
+			}
+			return err
+		case <-ctx.Done():
+			klog.Info("Stop Tokenizer")
+			stop(cmd, exited)
+			return ctx.Err()
+		case <-timer.C:
+		}
+		err := healthCheck(ctx, client)
+		switch {
+		case err == nil:
+			if !ready || failures > 0 {
+				klog.InfoS("tokenizer ready", "port", s.Port)
+			}
+			ready, failures = true, 0
+			setDown(false)
+		case !ready && time.Since(started) > StartTimeout:
+			stop(cmd, exited)
+			return fmt.Errorf("tokenizer not ready in %s: %v", StartTimeout, err)
+		case ready:
+			failures++
+			setDown(true)
+			klog.ErrorS(err, "tokenizer health check error", "failures", failures)
+			if failures >= HealthFailures {
+				stop(cmd, exited)
+				return fmt.Errorf("tokenizer unhealthy: %v", err)
+			}
+		}
+		if ready {
+			timer.Reset(HealthInterval)
+		} else {
+			timer.Reset(time.Second)
+		}
+	}
+}
+
+func healthCheck(ctx context.Context, client *Client) error {
+	ctx, cancel := context.WithTimeout(ctx, HealthTimeout)
+	defer cancel()
+	return client.ping(ctx)
+}
+
+// stop interrupts the process and kills it after StopTimeout
+func stop(cmd *exec.Cmd, exited chan error) {
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-exited:
+	case <-time.After(StopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+func setDown(value bool) {
+	if down.Swap(value) != value && value {
+		klog.Info("tokenizer down, estimate the tokens")
+	}
+}
@@ -1,45 +1,79 @@
 package tokenizer
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"strings"
+	"context"
+	"math"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/sashabaranov/go-openai"
 )
 
-type tokenInfo struct {
-	Code  int    `json:"code"`
-	Count int    `json:"num_tokens"`
-	Msg   string `json:"msg"`
+// Tokenizer counts the tokens of chat messages for a model
+type Tokenizer interface {
+	// Count returns the tokens of message and whether they are estimated rather than counted with
+	// the encoding of the model
+	Count(ctx context.Context, message openai.ChatCompletionMessage, model string) (int, bool, error)
+	CountBatch(ctx context.Context, messages []openai.ChatCompletionMessage, model string) ([]int, bool, error)
 }
 
-func GetTokenCount(message openai.ChatCompletionMessage, model string) (int, error) {
-	model = strings.ReplaceAll(model, "/", "-")
-	url := fmt.Sprintf("http://127.0.0.1:5000/tokenizer/%s", model)
-	info := tokenInfo{}
-	if err := postJSON(url, &message, &info); err != nil {
-		return 0, err
-	}
-	if info.Code != 200 {
-		return 0, fmt.Errorf("%v", info.Msg)
-	}
-	return info.Count, nil
+// Default counts the tokens of GetTokenCount and GetTokenCounts, tests may replace it with a stub
+var Default Tokenizer = NewClient(5000)
+
+var down atomic.Bool // set by the supervisor while the process is not healthy
+
+// SetPort points the default tokenizer to the process listening on port, before any count
+func SetPort(port int) {
+	Default = NewClient(port)
 }
 
-func postJSON(url string, requestData *openai.ChatCompletionMessage, responseData *tokenInfo) error {
-	requestBody, err := json.Marshal(requestData)
-	if err != nil {
-		return err
-	}
+// GetTokenCount counts the tokens of message with the default tokenizer, with whether they are estimated
+func GetTokenCount(ctx context.Context, message openai.ChatCompletionMessage, model string) (int, bool, error) {
+	return Default.Count(ctx, message, model)
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(requestBody))
-	if err != nil {
-		return err
+// GetTokenCounts counts the tokens of each of messages with the default tokenizer in one call,
+// with whether any of them is estimated
+func GetTokenCounts(ctx context.Context, messages []openai.ChatCompletionMessage, model string) ([]int, bool, error) {
+	return Default.CountBatch(ctx, messages, model)
+}
+
+// Estimate guesses the tokens of message from its characters, about 4 ASCII characters or
+// one other character per token, with the overhead of a message and the reply priming
+func Estimate(message openai.ChatCompletionMessage) int {
+	count := 3 + 3
+	for _, text := range []string{message.Role, message.Name, message.Content} {
+		ascii := 0
+		for _, r := range text {
+			if r < utf8.RuneSelf {
+				ascii++
+			} else {
+				count++
+			}
+		}
+		count += (ascii + 3) / 4
 	}
-	defer resp.Body.Close()
+	return count
+}
 
-	return json.NewDecoder(resp.Body).Decode(responseData)
+// GetImageTokenCount estimates the tokens of an image input the way OpenAI vision models bill it,
+// low detail costs a flat 85 tokens, otherwise 170 tokens per 512px tile plus 85
+func GetImageTokenCount(width, height int, detail string) int {
+	if detail == "low" {
+		return 85
+	}
+	if width <= 0 || height <= 0 {
+		width, height = 2048, 2048
+	}
+	w, h := float64(width), float64(height)
+	if w > 2048 || h > 2048 {
+		scale := 2048 / math.Max(w, h)
+		w, h = w*scale, h*scale
+	}
+	if math.Min(w, h) > 768 {
+		scale := 768 / math.Min(w, h)
+		w, h = w*scale, h*scale
+	}
+	tiles := int(math.Ceil(w/512) * math.Ceil(h/512))
+	return 170*tiles + 85
 }
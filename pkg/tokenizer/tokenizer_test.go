@@ -0,0 +1,46 @@
+package tokenizer
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		name    string
+		message openai.ChatCompletionMessage
+		want    int
+	}{
+		{"empty", openai.ChatCompletionMessage{}, 6},
+		{"ascii", openai.ChatCompletionMessage{Role: "user", Content: "hello world"}, 6 + 1 + 3},
+		{"cjk", openai.ChatCompletionMessage{Role: "user", Content: "你好"}, 6 + 1 + 2},
+		{"mixed", openai.ChatCompletionMessage{Role: "user", Content: "hi 你好"}, 6 + 1 + 1 + 2},
+		{"with name", openai.ChatCompletionMessage{Role: "tool", Name: "search", Content: "ok"}, 6 + 1 + 2 + 1},
+	}
+	for _, tt := range tests {
+		if got := Estimate(tt.message); got != tt.want {
+			t.Errorf("%s: Estimate() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetImageTokenCount(t *testing.T) {
+	tests := []struct {
+		width, height int
+		detail        string
+		want          int
+	}{
+		{4096, 4096, "low", 85},
+		{512, 512, "high", 170 + 85},
+		{513, 512, "auto", 2*170 + 85},
+		{1024, 1024, "high", 4*170 + 85},
+		{4096, 2048, "high", 6*170 + 85},
+		{0, 0, "high", 4*170 + 85},
+	}
+	for _, tt := range tests {
+		if got := GetImageTokenCount(tt.width, tt.height, tt.detail); got != tt.want {
+			t.Errorf("GetImageTokenCount(%d, %d, %s) = %d, want %d", tt.width, tt.height, tt.detail, got, tt.want)
+		}
+	}
+}
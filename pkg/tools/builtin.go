@@ -0,0 +1,253 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	FetchMaxBytes = 64 << 10
+	FetchTimeout  = 10 * time.Second
+)
+
+type CurrentTime struct{}
+
+func (t *CurrentTime) Definition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{
+		Name:        "current_time",
+		Description: "Get the current date and time, optionally in an IANA timezone such as Asia/Shanghai",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string","description":"IANA timezone name"}}}`),
+	}
+}
+
+func (t *CurrentTime) Call(ctx context.Context, username string, arguments string) (string, error) {
+	args := struct {
+		Timezone string `json:"timezone"`
+	}{}
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if args.Timezone != "" {
+		location, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", err
+		}
+		now = now.In(location)
+	}
+	return now.Format("2006-01-02 15:04:05 Monday MST"), nil
+}
+
+// Calculator evaluates arithmetic with + - * / % and parentheses through the go expression parser
+type Calculator struct{}
+
+func (t *Calculator) Definition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression with + - * / % and parentheses, for example (1.5+2)*3",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string"}},"required":["expression"]}`),
+	}
+}
+
+func (t *Calculator) Call(ctx context.Context, username string, arguments string) (string, error) {
+	args := struct {
+		Expression string `json:"expression"`
+	}{}
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	expr, err := parser.ParseExpr(args.Expression)
+	if err != nil {
+		return "", fmt.Errorf("invalid expression %v", err)
+	}
+	value, err := evaluate(expr)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64), nil
+}
+
+func evaluate(expr ast.Expr) (float64, error) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return 0, fmt.Errorf("unsupported literal %s", e.Value)
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.ParenExpr:
+		return evaluate(e.X)
+	case *ast.UnaryExpr:
+		x, err := evaluate(e.X)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.SUB:
+			return -x, nil
+		case token.ADD:
+			return x, nil
+		}
+		return 0, fmt.Errorf("unsupported operator %s", e.Op)
+	case *ast.BinaryExpr:
+		x, err := evaluate(e.X)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evaluate(e.Y)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return x / y, nil
+		case token.REM:
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return math.Mod(x, y), nil
+		}
+		return 0, fmt.Errorf("unsupported operator %s", e.Op)
+	}
+	return 0, fmt.Errorf("unsupported expression")
+}
+
+// FetchURL gets a web page from an allowlisted host and returns its text
+type FetchURL struct {
+	allowlist map[string]bool
+	client    *http.Client
+}
+
+func NewFetchURL(allowlist []string) *FetchURL {
+	hosts := map[string]bool{}
+	for _, host := range allowlist {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return &FetchURL{
+		allowlist: hosts,
+		client: &http.Client{
+			Timeout: FetchTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if !hosts[strings.ToLower(req.URL.Hostname())] {
+					return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func (t *FetchURL) Definition() openai.FunctionDefinition {
+	hosts := make([]string, 0, len(t.allowlist))
+	for host := range t.allowlist {
+		hosts = append(hosts, host)
+	}
+	return openai.FunctionDefinition{
+		Name:        "fetch_url",
+		Description: fmt.Sprintf("Fetch the text of a web page, only these hosts are allowed: %s", strings.Join(hosts, ", ")),
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"url":{"type":"string"}},"required":["url"]}`),
+	}
+}
+
+var (
+	scriptPattern = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	tagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacePattern  = regexp.MustCompile(`\s{2,}`)
+)
+
+func (t *FetchURL) Call(ctx context.Context, username string, arguments string) (string, error) {
+	args := struct {
+		URL string `json:"url"`
+	}{}
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	target, err := url.Parse(args.URL)
+	if err != nil {
+		return "", err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || !t.allowlist[strings.ToLower(target.Hostname())] {
+		return "", fmt.Errorf("url %s is not allowed", args.URL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %s status %d", args.URL, rsp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, FetchMaxBytes))
+	if err != nil {
+		return "", err
+	}
+	text := string(body)
+	if strings.Contains(rsp.Header.Get("Content-Type"), "html") {
+		text = scriptPattern.ReplaceAllString(text, " ")
+		text = tagPattern.ReplaceAllString(text, " ")
+		text = spacePattern.ReplaceAllString(text, "\n")
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// SearchHistory finds messages of the calling user that contain the query
+type SearchHistory struct {
+	Search func(username, query string, limit int) []string
+}
+
+func (t *SearchHistory) Definition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{
+		Name:        "search_history",
+		Description: "Search the user's own recent conversation history for messages containing a keyword",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string"},"limit":{"type":"integer"}},"required":["query"]}`),
+	}
+}
+
+func (t *SearchHistory) Call(ctx context.Context, username string, arguments string) (string, error) {
+	args := struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}{}
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	if args.Limit <= 0 || args.Limit > 10 {
+		args.Limit = 5
+	}
+	if t.Search == nil || strings.TrimSpace(args.Query) == "" {
+		return "no results", nil
+	}
+	results := t.Search(username, args.Query, args.Limit)
+	if len(results) == 0 {
+		return "no results", nil
+	}
+	return strings.Join(results, "\n---\n"), nil
+}
@@ -0,0 +1,92 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Tool is a function the model can call during a chat completion
+type Tool interface {
+	Definition() openai.FunctionDefinition
+	Call(ctx context.Context, username string, arguments string) (string, error)
+}
+
+type Registry struct {
+	tools map[string]Tool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tools: map[string]Tool{},
+	}
+}
+
+func (r *Registry) Register(tool Tool) {
+	r.tools[tool.Definition().Name] = tool
+}
+
+func (r *Registry) Len() int {
+	return len(r.tools)
+}
+
+// Definitions returns the tools in the request format, sorted by name
+func (r *Registry) Definitions() []openai.Tool {
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	definitions := make([]openai.Tool, 0, len(names))
+	for _, name := range names {
+		definition := r.tools[name].Definition()
+		definitions = append(definitions, openai.Tool{
+			Type:     openai.ToolTypeFunction,
+			Function: &definition,
+		})
+	}
+	return definitions
+}
+
+func (r *Registry) Call(ctx context.Context, username, name, arguments string) (string, error) {
+	tool, ok := r.tools[name]
+	if !ok {
+		return "", fmt.Errorf("unknown tool %s", name)
+	}
+	return tool.Call(ctx, username, arguments)
+}
+
+// NewBuiltinRegistry registers the enabled built-in tools by name, history searches the conversations of a user
+func NewBuiltinRegistry(enabled []string, fetchAllowlist []string, history func(username, query string, limit int) []string) (*Registry, error) {
+	registry := NewRegistry()
+	for _, name := range enabled {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "current_time":
+			registry.Register(&CurrentTime{})
+		case "calculator":
+			registry.Register(&Calculator{})
+		case "fetch_url":
+			registry.Register(NewFetchURL(fetchAllowlist))
+		case "search_history":
+			registry.Register(&SearchHistory{Search: history})
+		default:
+			return nil, fmt.Errorf("unknown built-in tool %s", name)
+		}
+	}
+	return registry, nil
+}
+
+func parseArguments(arguments string, v interface{}) error {
+	if strings.TrimSpace(arguments) == "" {
+		arguments = "{}"
+	}
+	if err := json.Unmarshal([]byte(arguments), v); err != nil {
+		return fmt.Errorf("invalid arguments %v", err)
+	}
+	return nil
+}
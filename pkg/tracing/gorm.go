@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "tracing:span"
+
+var rowsAffected = attribute.Key("db.rows_affected")
+
+// GormPlugin records a span for every query run with the context of a traced request
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	register := []struct {
+		op     string
+		before func(name string, fn func(*gorm.DB)) error
+		after  func(name string, fn func(*gorm.DB)) error
+	}{
+		{"create", callbacks.Create().Before("gorm:create").Register, callbacks.Create().After("gorm:create").Register},
+		{"query", callbacks.Query().Before("gorm:query").Register, callbacks.Query().After("gorm:query").Register},
+		{"update", callbacks.Update().Before("gorm:update").Register, callbacks.Update().After("gorm:update").Register},
+		{"delete", callbacks.Delete().Before("gorm:delete").Register, callbacks.Delete().After("gorm:delete").Register},
+		{"row", callbacks.Row().Before("gorm:row").Register, callbacks.Row().After("gorm:row").Register},
+		{"raw", callbacks.Raw().Before("gorm:raw").Register, callbacks.Raw().After("gorm:raw").Register},
+	}
+	for _, item := range register {
+		if err := item.before("tracing:before_"+item.op, startQuery(item.op)); err != nil {
+			return err
+		}
+		if err := item.after("tracing:after_"+item.op, endQuery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startQuery(op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		_, span := Start(ctx, "db."+op,
+			semconv.DBSystemKey.String(db.Dialector.Name()),
+			semconv.DBSQLTableKey.String(db.Statement.Table),
+		)
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func endQuery(db *gorm.DB) {
+	value, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	// the statement keeps the placeholders, values such as passwords are not recorded
+	span.SetAttributes(
+		semconv.DBStatementKey.String(db.Statement.SQL.String()),
+		semconv.DBSQLTableKey.String(db.Statement.Table),
+		rowsAffected.Int64(db.Statement.RowsAffected),
+	)
+	err := db.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	End(span, err)
+}
@@ -1,29 +1,84 @@
 from nuxt import route, logger, Request
 from nuxt.repositorys.validation import fields, use_args
+import fnmatch
+import json
+import os
 import traceback
 import tiktoken
 
 encoding_cache = {}
 
-support_models = set(["gpt-3.5-turbo",
-                      "gpt-3.5-turbo-16k",
-                      "gpt-4",
-                      "gpt-4-32k",
-                      "gpt-4o",
-                      "gpt-4o-mini"])
+# models are matched by the longest pattern, * matches any suffix
+default_encodings = {
+    "default": "cl100k_base",
+    "models": {
+        "gpt-3.5-turbo*": {"encoding": "cl100k_base"},
+        "gpt-3.5-turbo-0301": {"encoding": "cl100k_base", "tokens_per_message": 4, "tokens_per_name": -1},
+        "gpt-4*": {"encoding": "cl100k_base"},
+        "gpt-4o*": {"encoding": "o200k_base"},
+        "gpt-4.1*": {"encoding": "o200k_base"},
+        "gpt-4.5*": {"encoding": "o200k_base"},
+        "gpt-5*": {"encoding": "o200k_base"},
+        "chatgpt-4o*": {"encoding": "o200k_base"},
+        "o1*": {"encoding": "o200k_base"},
+        "o3*": {"encoding": "o200k_base"},
+        "o4*": {"encoding": "o200k_base"}
+    }
+}
 
 
-@route("/tokenizer/<str:model_name>", methods=["POST"])
-@use_args({
+def load_encodings():
+    """Returns the built-in mapping updated by the TOKENIZER_ENCODINGS json file."""
+    encodings = {"default": default_encodings["default"], "models": dict(default_encodings["models"])}
+    path = os.environ.get("TOKENIZER_ENCODINGS", "")
+    if path:
+        with open(path) as f:
+            custom = json.load(f)
+        encodings["default"] = custom.get("default", encodings["default"])
+        encodings["models"].update(custom.get("models", {}))
+    return encodings
+
+
+encodings = load_encodings()
+
+
+message_args = {
     "role": fields.Str(required=True),
     "content": fields.Str(required=True),
     "name": fields.Str(required=False)
-}, location="json")
+}
+
+
+@route("/tokenizer/<str:model_name>", methods=["POST"])
+@use_args(message_args, location="json")
 def get_num_tokens(req: Request, message: dict, model_name: str):
     try:
+        num_tokens, estimated = num_tokens_from_messages([message], model=request_model(req, model_name))
+        return {
+            "code": 200,
+            "num_tokens": num_tokens,
+            "estimated": estimated
+        }
+    except Exception as e:
+        logger.error(traceback.format_exc())
+        return {
+            "code": 500,
+            "msg": "{}".format(e)
+        }
+
+
+@route("/tokenizer/<str:model_name>/batch", methods=["POST"])
+@use_args({
+    "messages": fields.List(fields.Nested(message_args), required=True)
+}, location="json")
+def get_batch_num_tokens(req: Request, args: dict, model_name: str):
+    try:
+        model = request_model(req, model_name)
+        counts = [num_tokens_from_messages([message], model=model) for message in args["messages"]]
         return {
             "code": 200,
-            "num_tokens": num_tokens_from_messages([message], model=model_name)
+            "counts": [num_tokens for num_tokens, _ in counts],
+            "estimated": any(estimated for _, estimated in counts)
         }
     except Exception as e:
         logger.error(traceback.format_exc())
@@ -33,43 +88,36 @@ def get_num_tokens(req: Request, message: dict, model_name: str):
         }
 
 
+def request_model(req, model_name):
+    """Returns the model name of the query, the path has / replaced by -."""
+    return req.args.get("model") or model_name
+
+
+def model_rule(model):
+    """Returns the rule of the longest pattern matching model, None for unknown models."""
+    matched = None
+    for pattern in encodings["models"]:
+        if fnmatch.fnmatchcase(model, pattern) and (matched is None or len(pattern) > len(matched)):
+            matched = pattern
+    if matched is None:
+        return None
+    return encodings["models"][matched]
+
+
 def num_tokens_from_messages(messages, model="gpt-3.5-turbo"):
-    """Returns the number of tokens used by a list of messages."""
-    encoding = None
-    if not model in support_models:  # note: let other model run
-        return 0
-    if model in encoding_cache:
-        encoding = encoding_cache.get(model)
-    else:
-        try:
-            encoding = tiktoken.encoding_for_model(model)
-        except KeyError:
-            encoding = tiktoken.get_encoding("cl100k_base")
-        encoding_cache[model] = encoding
-    return _inner_num_tokens_from_messages(messages, encoding, model)
-
-
-def _inner_num_tokens_from_messages(messages, encoding, model):
-    """Return the number of tokens used by a list of messages."""
-    if model in {
-        "gpt-3.5-turbo-0613",
-        "gpt-3.5-turbo-16k-0613",
-        "gpt-4-0314",
-        "gpt-4-32k-0314",
-        "gpt-4-0613",
-        "gpt-4-32k-0613",
-    }:
-        tokens_per_message = 3
-        tokens_per_name = 1
-    elif model == "gpt-3.5-turbo-0301":
-        tokens_per_message = 4  # every message follows <|start|>{role/name}\n{content}<|end|>\n
-        tokens_per_name = -1  # if there's a name, the role is omitted
-    elif "gpt-3.5-turbo" in model:
-        return _inner_num_tokens_from_messages(messages, encoding, model="gpt-3.5-turbo-0613")
-    elif "gpt-4" in model:
-        return _inner_num_tokens_from_messages(messages, encoding, model="gpt-4-0613")
-    else:
-        raise NotImplementedError(f"""num_tokens_from_messages() is not implemented for model {model}.""")
+    """Returns the number of tokens used by a list of messages and whether it is estimated
+    with the default encoding of an unknown model."""
+    rule = model_rule(model)
+    estimated = rule is None
+    if rule is None:
+        rule = {}
+    name = rule.get("encoding", encodings["default"])
+    encoding = encoding_cache.get(name)
+    if encoding is None:
+        encoding = tiktoken.get_encoding(name)
+        encoding_cache[name] = encoding
+    tokens_per_message = rule.get("tokens_per_message", 3)
+    tokens_per_name = rule.get("tokens_per_name", 1)
     num_tokens = 0
     for message in messages:
         num_tokens += tokens_per_message
@@ -77,5 +125,5 @@ def _inner_num_tokens_from_messages(messages, encoding, model):
             num_tokens += len(encoding.encode(value))
             if key == "name":
                 num_tokens += tokens_per_name
-    num_tokens += 3  # every reply is primed with <|start|>assistant<|message|>
-    return num_tokens
+    num_tokens += rule.get("tokens_per_reply", 3)  # every reply is primed with <|start|>assistant<|message|>
+    return num_tokens, estimated